@@ -2,6 +2,8 @@
 package config
 
 import (
+	"fmt"
+
 	"github.com/caarlos0/env/v6"
 )
 
@@ -9,6 +11,20 @@ import (
 type Config struct {
 	ServerHost string `env:"SERVER_HOST,notEmpty" envDefault:"localhost"`
 	ServerPort string `env:"SERVER_PORT,notEmpty" envDefault:"12345"`
+
+	SolverWorkers int `env:"SOLVER_WORKERS" envDefault:"0"`
+	// ClientID - ID sent to the server, telling the client apart from the others sharing its address
+	ClientID string `env:"CLIENT_ID"`
+
+	// TLSEnabled - whether the server is dialed over TLS
+	TLSEnabled bool `env:"TLS_ENABLED" envDefault:"false"`
+	// TLSCAFile - PEM bundle of the CAs verifying the server certificate, the system ones if empty
+	TLSCAFile string `env:"TLS_CA_FILE"`
+	// TLSServerName - name the server certificate is verified for, SERVER_HOST if empty
+	TLSServerName string `env:"TLS_SERVER_NAME"`
+	// TLSCertFile, TLSKeyFile - certificate authenticating the client to the server, optional
+	TLSCertFile string `env:"TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"TLS_KEY_FILE"`
 }
 
 // New creates a new config of the service
@@ -20,5 +36,9 @@ func New() (*Config, error) {
 		return nil, err
 	}
 
+	if (cfg.TLSCertFile != "") != (cfg.TLSKeyFile != "") {
+		return nil, fmt.Errorf(`TLS_CERT_FILE and TLS_KEY_FILE must be set together`)
+	}
+
 	return cfg, err
 }
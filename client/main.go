@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
 	"net"
+	"os"
 
 	"github.com/OVantsevich/faraway-test/protocol"
 	"github.com/gdamore/tcell/v2"
@@ -15,45 +19,115 @@ import (
 var app = tview.NewApplication()
 var text = tview.NewTextView().
 	SetTextColor(tcell.ColorGreen).
-	SetText("(a) to get random quote \n(q) to quit")
+	SetText("(a) to get random quote \n(c) to cancel \n(q) to quit")
 var quote = tview.NewTextView().
 	SetTextColor(tcell.ColorBisque)
+var status = tview.NewTextView().
+	SetTextColor(tcell.ColorGray)
 var flex = tview.NewFlex()
 
+// cancel interrupts the request in flight. It is accessed from the event loop only.
+var cancel context.CancelFunc
+
 func main() {
 	cfg, err := config.New()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	conn, err := net.Dial("tcp", fmt.Sprint(cfg.ServerHost, ":", cfg.ServerPort))
+	dial, err := dialer(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := dial()
 	if err != nil {
 		log.Fatal(err)
 	}
-	client, err := protocol.NewClient(conn)
+	client, err := protocol.NewClient(conn, protocol.WithSolver(protocol.SolverConfig{
+		Workers: cfg.SolverWorkers,
+		OnProgress: func(p protocol.Progress) {
+			app.QueueUpdateDraw(func() {
+				status.SetText(fmt.Sprintf("hashes: %d, hash rate: %.0f H/s, ETA: %v", p.Hashes, p.HashRate, p.ETA))
+			})
+		},
+	}), protocol.WithClientID(cfg.ClientID))
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Rune() == 113 {
-			app.Stop()
-		} else if event.Rune() == 97 {
-			quoteText, err := client.GetQuote()
-			if err != nil {
-				quote.SetText(err.Error())
-			} else {
-				quote.SetText(quoteText)
+			if cancel != nil {
+				cancel()
 			}
-			go app.Draw()
+			app.Stop()
+		} else if event.Rune() == 97 && cancel == nil {
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			status.SetText("waiting for the server...")
+			go getQuote(ctx, client, dial)
+		} else if event.Rune() == 99 && cancel != nil {
+			cancel()
 		}
 		return event
 	})
 	flex.SetDirection(tview.FlexRow).AddItem(
 		tview.NewFlex().AddItem(text, 0, 1, false).
-			AddItem(quote, 0, 4, false), 0, 1, true)
+			AddItem(quote, 0, 4, false), 0, 1, true).
+		AddItem(status, 1, 0, false)
 
 	if err := app.SetRoot(flex, true).EnableMouse(true).Run(); err != nil {
 		panic(err)
 	}
 }
+
+// getQuote requests a quote without blocking the event loop and shows the result.
+func getQuote(ctx context.Context, client *protocol.Client, dial func() (net.Conn, error)) {
+	quoteText, err := client.GetQuoteContext(ctx)
+	if err != nil {
+		// The connection may be lost or interrupted, reconnect to redeem the solved challenge with the next request
+		if conn, dialErr := dial(); dialErr == nil && client.Reconnect(conn) == nil {
+			quoteText = fmt.Sprint(err.Error(), "\nreconnected, try again")
+		} else {
+			quoteText = err.Error()
+		}
+	}
+
+	app.QueueUpdateDraw(func() {
+		quote.SetText(quoteText)
+		status.SetText("")
+		cancel()
+		cancel = nil
+	})
+}
+
+// dialer returns the function connecting to the server, over TLS if it is enabled.
+func dialer(cfg *config.Config) (func() (net.Conn, error), error) {
+	address := net.JoinHostPort(cfg.ServerHost, cfg.ServerPort)
+	if !cfg.TLSEnabled {
+		return func() (net.Conn, error) { return net.Dial("tcp", address) }, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: cfg.TLSServerName, MinVersion: tls.VersionTLS12}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = cfg.ServerHost
+	}
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("dialer - ReadFile: %v", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("dialer - AppendCertsFromPEM: no certificates in %s", cfg.TLSCAFile)
+		}
+	}
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("dialer - LoadX509KeyPair: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return func() (net.Conn, error) { return tls.Dial("tcp", address, tlsConfig) }, nil
+}
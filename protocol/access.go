@@ -0,0 +1,270 @@
+package protocol
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// accessTokenVersion - version of the access token layout.
+	accessTokenVersion = 1
+	// accessIDLen - len of the random ID of an access token in bytes.
+	accessIDLen = 16
+	// accessTokenLen - len of a signed access token in bytes:
+	// version, ID, expiry time, number of requests, client binding and HMAC-SHA256 signature.
+	accessTokenLen = 1 + accessIDLen + 8 + 4 + sha256.Size + sha256.Size
+	// accessGrantLen - len of the payload of an access frame preceding the token:
+	// number of requests uint32 and time to live in milliseconds uint32.
+	accessGrantLen = 8
+	// defaultAccessTTL - the time an access token is valid unless configured otherwise.
+	defaultAccessTTL = time.Minute
+	// defaultAccessCacheSize - the maximum number of access tokens whose requests are counted unless configured otherwise.
+	defaultAccessCacheSize = 1 << 16
+)
+
+// AccessConfig represents the configuration of access tokens. After a solved challenge the client gets a token
+// signed by the server, and its next MaxRequests requests attaching the token are served without a challenge
+// until it expires.
+type AccessConfig struct {
+	// MaxRequests - the number of requests a token is valid for
+	MaxRequests int
+	// TTL - the time a token is valid for, a minute if zero
+	TTL time.Duration
+	// CacheSize - the maximum number of tokens whose requests are counted, 65536 if zero. Tokens are forgotten
+	// once they expire only; while the cache is full of valid tokens, new ones are not redeemed and their
+	// requests are challenged
+	CacheSize int
+}
+
+// WithAccessTokens enables access tokens for clients of AccessTokenVersion and later.
+// Tokens are signed with the key of the challenges, their requests are counted by each server on its own.
+func WithAccessTokens(cfg AccessConfig) ServerOption {
+	return func(s *Server) {
+		if cfg.TTL == 0 {
+			cfg.TTL = defaultAccessTTL
+		}
+		if cfg.CacheSize == 0 {
+			cfg.CacheSize = defaultAccessCacheSize
+		}
+		s.access = &accessTokens{cfg: cfg, usage: newUsageCache(cfg.CacheSize)}
+	}
+}
+
+// accessToken represents the content of an access token.
+type accessToken struct {
+	// id - random ID of the token, its requests are counted by it
+	id [accessIDLen]byte
+	// expires - time after which the token is not accepted
+	expires time.Time
+	// maxRequests - the number of requests the token is valid for
+	maxRequests uint32
+	// binding - checksum of the client data the token was issued for
+	binding [sha256.Size]byte
+}
+
+// sign encodes the token and appends its HMAC signature.
+func (t *accessToken) sign(key []byte) []byte {
+	raw := make([]byte, 0, accessTokenLen)
+	raw = append(raw, accessTokenVersion)
+	raw = append(raw, t.id[:]...)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(t.expires.UnixMilli()))
+	raw = binary.BigEndian.AppendUint32(raw, t.maxRequests)
+	raw = append(raw, t.binding[:]...)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	return mac.Sum(raw)
+}
+
+// parseAccessToken decodes the token and verifies its signature.
+func parseAccessToken(raw, key []byte) (*accessToken, error) {
+	if len(raw) != accessTokenLen {
+		return nil, fmt.Errorf("parseAccessToken: invalid token length %d", len(raw))
+	}
+	if raw[0] != accessTokenVersion {
+		return nil, fmt.Errorf("parseAccessToken: unsupported token version %d", raw[0])
+	}
+	signed := raw[:len(raw)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), raw[len(signed):]) {
+		return nil, fmt.Errorf("parseAccessToken: invalid signature")
+	}
+
+	t := &accessToken{
+		expires:     time.UnixMilli(int64(binary.BigEndian.Uint64(raw[1+accessIDLen:]))),
+		maxRequests: binary.BigEndian.Uint32(raw[1+accessIDLen+8:]),
+	}
+	copy(t.id[:], raw[1:])
+	copy(t.binding[:], raw[1+accessIDLen+8+4:])
+	return t, nil
+}
+
+// attachAccessToken prefixes the payload of a request with the access token, see FlagAccessToken.
+func attachAccessToken(token, payload []byte) ([]byte, error) {
+	if len(token) > math.MaxUint16 {
+		return nil, fmt.Errorf("attachAccessToken: token of %d bytes is too long", len(token))
+	}
+	buf := make([]byte, 0, 2+len(token)+len(payload))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(token)))
+	buf = append(buf, token...)
+	return append(buf, payload...), nil
+}
+
+// splitAccessToken splits the payload of a request carrying an access token into the token and the request.
+func splitAccessToken(payload []byte) ([]byte, []byte, error) {
+	if len(payload) < 2 {
+		return nil, nil, fmt.Errorf("splitAccessToken: missing token length")
+	}
+	size := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+size {
+		return nil, nil, fmt.Errorf("splitAccessToken: truncated token of %d bytes", size)
+	}
+	return payload[2 : 2+size], payload[2+size:], nil
+}
+
+// accessGrant represents an access token granted to the client.
+type accessGrant struct {
+	// token - the token attached to the requests
+	token []byte
+	// remaining - the number of requests the token is still valid for
+	remaining int
+	// expires - time after which the token is no longer attached
+	expires time.Time
+}
+
+// parseAccessGrant decodes the payload of an access frame. The token is considered expired once its time
+// to live has passed since it was received, which is a bit earlier than the server expires it.
+func parseAccessGrant(payload []byte) (*accessGrant, error) {
+	if len(payload) <= accessGrantLen {
+		return nil, fmt.Errorf("parseAccessGrant: invalid payload length %d", len(payload))
+	}
+	ttl := time.Duration(binary.BigEndian.Uint32(payload[4:])) * time.Millisecond
+	return &accessGrant{
+		token:     append([]byte(nil), payload[accessGrantLen:]...),
+		remaining: int(binary.BigEndian.Uint32(payload)),
+		expires:   time.Now().Add(ttl),
+	}, nil
+}
+
+// accessTokens issues access tokens and counts their requests.
+type accessTokens struct {
+	// Access tokens configuration
+	cfg AccessConfig
+	// usage - numbers of requests made with the tokens
+	usage *usageCache
+}
+
+// issue creates a new access token bound to the client data and returns the payload of the access frame
+// granting it: number of requests uint32, time to live in milliseconds uint32 and the token.
+func (a *accessTokens) issue(key, data []byte) ([]byte, error) {
+	t := &accessToken{
+		expires:     time.Now().Add(a.cfg.TTL),
+		maxRequests: uint32(a.cfg.MaxRequests),
+		binding:     clientBinding(data),
+	}
+	_, err := rand.Read(t.id[:])
+	if err != nil {
+		return nil, fmt.Errorf("issue - Read: %v", err)
+	}
+
+	payload := make([]byte, 0, accessGrantLen+accessTokenLen)
+	payload = binary.BigEndian.AppendUint32(payload, t.maxRequests)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(a.cfg.TTL.Milliseconds()))
+	return append(payload, t.sign(key)...), nil
+}
+
+// redeem counts a request made with the token. It returns an error unless the token is signed with the key,
+// bound to the client data, not expired and not exhausted.
+func (a *accessTokens) redeem(key, data, raw []byte) error {
+	t, err := parseAccessToken(raw, key)
+	if err != nil {
+		return fmt.Errorf("redeem - parseAccessToken: %v", err)
+	}
+	binding := clientBinding(data)
+	if !hmac.Equal(t.binding[:], binding[:]) {
+		return fmt.Errorf("redeem: token is issued for another client")
+	}
+	now := time.Now()
+	if now.After(t.expires) {
+		return fmt.Errorf("redeem: token is expired")
+	}
+	err = a.usage.use(t.id, t.maxRequests, t.expires, now)
+	if err != nil {
+		return fmt.Errorf("redeem - use: %v", err)
+	}
+	return nil
+}
+
+// usageEntry represents the number of requests made with an access token.
+type usageEntry struct {
+	id      [accessIDLen]byte
+	used    uint32
+	expires time.Time
+}
+
+// usageCache counts the requests made with access tokens until they expire. Like the replay cache, it keeps
+// the entries in the order of insertion and drops the expired ones from the front. Unlike it, it never drops
+// a valid token, whose requests would be counted anew, but refuses to count new tokens when full.
+type usageCache struct {
+	// maxSize - maximum number of counted tokens
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[[accessIDLen]byte]*list.Element
+	order   *list.List
+}
+
+// newUsageCache creates a new usage cache counting the requests of at most maxSize tokens.
+func newUsageCache(maxSize int) *usageCache {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &usageCache{
+		maxSize: maxSize,
+		entries: make(map[[accessIDLen]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// use counts a request made with the token. It returns an error if maxRequests requests have already been made,
+// or if the token is not counted yet and the cache is full of valid tokens.
+func (c *usageCache) use(id [accessIDLen]byte, maxRequests uint32, expires, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for front := c.order.Front(); front != nil && !front.Value.(*usageEntry).expires.After(now); front = c.order.Front() {
+		c.remove(front)
+	}
+
+	if e, ok := c.entries[id]; ok {
+		entry := e.Value.(*usageEntry)
+		if entry.used >= maxRequests {
+			return fmt.Errorf("use: token is exhausted")
+		}
+		entry.used++
+		return nil
+	}
+	if maxRequests == 0 {
+		return fmt.Errorf("use: token is exhausted")
+	}
+
+	if c.order.Len() >= c.maxSize {
+		return fmt.Errorf("use: %d valid tokens are counted already", c.maxSize)
+	}
+	c.entries[id] = c.order.PushBack(&usageEntry{id: id, used: 1, expires: expires})
+	return nil
+}
+
+// remove forgets the token.
+func (c *usageCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*usageEntry).id)
+	c.order.Remove(e)
+}
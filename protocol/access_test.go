@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccessTokens(t *testing.T) {
+	access := &accessTokens{cfg: AccessConfig{MaxRequests: 2, TTL: time.Minute}, usage: newUsageCache(2)}
+	key, data := []byte("secret"), []byte("127.0.0.1")
+
+	payload, err := access.issue(key, data)
+	require.NoError(t, err)
+	grant, err := parseAccessGrant(payload)
+	require.NoError(t, err)
+	require.Equal(t, 2, grant.remaining)
+
+	// The token is valid for its requests only, by the client it is issued for
+	require.Error(t, access.redeem([]byte("another secret"), data, grant.token))
+	require.Error(t, access.redeem(key, []byte("127.0.0.2"), grant.token))
+	require.NoError(t, access.redeem(key, data, grant.token))
+	require.NoError(t, access.redeem(key, data, grant.token))
+	require.Error(t, access.redeem(key, data, grant.token))
+
+	// Expired tokens are forgotten
+	usage := newUsageCache(2)
+	var id [accessIDLen]byte
+	now := time.Now()
+	require.NoError(t, usage.use(id, 1, now.Add(time.Second), now))
+	require.Error(t, usage.use(id, 1, now.Add(time.Second), now))
+	require.NoError(t, usage.use([accessIDLen]byte{1}, 1, now.Add(time.Minute), now.Add(2*time.Second)))
+	require.NotContains(t, usage.entries, id)
+
+	// Valid tokens are not forgotten when full, new tokens are refused instead
+	require.NoError(t, usage.use([accessIDLen]byte{2}, 2, now.Add(time.Minute), now.Add(2*time.Second)))
+	require.Error(t, usage.use([accessIDLen]byte{3}, 2, now.Add(time.Minute), now.Add(2*time.Second)))
+	require.NoError(t, usage.use([accessIDLen]byte{2}, 2, now.Add(time.Minute), now.Add(2*time.Second)))
+	require.Error(t, usage.use([accessIDLen]byte{2}, 2, now.Add(time.Minute), now.Add(2*time.Second)))
+	require.NoError(t, usage.use([accessIDLen]byte{3}, 2, now.Add(2*time.Minute), now.Add(time.Minute)))
+
+	token, req, err := splitAccessToken(mustAttach(t, grant.token, []byte(CmdGetQuote)))
+	require.NoError(t, err)
+	require.Equal(t, grant.token, token)
+	require.Equal(t, []byte(CmdGetQuote), req)
+	_, _, err = splitAccessToken([]byte{0, 4, 1})
+	require.Error(t, err)
+}
+
+func mustAttach(t *testing.T, token, payload []byte) []byte {
+	buf, err := attachAccessToken(token, payload)
+	require.NoError(t, err)
+	return buf
+}
+
+func TestServer_AccessTokens(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(4, time.Second*10, WithSecret([]byte("secret")))
+	reputation := NewReputation(ReputationConfig{RequestPenalty: 1.5, HalfLife: time.Hour, MaxExtraBits: 8})
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	}, WithAccessTokens(AccessConfig{MaxRequests: 2}), WithReputation(reputation))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, c.Session().Version, AccessTokenVersion)
+	addr := conn.LocalAddr()
+
+	// The solved challenge grants a token for the next two requests, also on a new connection
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+	require.NotNil(t, c.access)
+	require.Equal(t, 2, c.access.remaining)
+	token := c.access.token
+
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, 1, c.access.remaining)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, c.Reconnect(conn))
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, 0, c.access.remaining)
+	require.Equal(t, token, c.access.token)
+
+	// The requests served with the token count towards the reputation like the challenged one
+	require.Equal(t, uint8(4), reputation.ExtraBits(addr, ""))
+
+	// Once it is exhausted, the client solves a new challenge granting a new token
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, 2, c.access.remaining)
+	require.NotEqual(t, token, c.access.token)
+
+	// A token the server does not accept is answered with a challenge
+	token = append([]byte(nil), c.access.token...)
+	c.access.token[0] ^= 0xff
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, 2, c.access.remaining)
+	require.NotEqual(t, token, c.access.token)
+}
@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// SHA256 - name of the Hashcash algorithm based on a single SHA-256 checksum.
+	SHA256 = "sha256"
+	// Argon2id - name of the memory-hard algorithm based on Argon2id.
+	Argon2id = "argon2id"
+	// Scrypt - name of the memory-hard algorithm based on scrypt.
+	Scrypt = "scrypt"
+)
+
+const (
+	// argon2Time - number of passes over the memory.
+	argon2Time = 1
+	// argon2Memory - memory used by a single hash in KiB.
+	argon2Memory = 4 * 1024
+	// argon2Threads - number of lanes of a single hash.
+	argon2Threads = 1
+
+	// scryptN - CPU/memory cost parameter, 128 * scryptN * scryptR bytes of memory are used by a single hash.
+	scryptN = 4096
+	// scryptR - block size parameter.
+	scryptR = 8
+	// scryptP - parallelization parameter.
+	scryptP = 1
+)
+
+// algorithmSalt - salt of memory-hard algorithms. The randomness of a puzzle comes from the challenge data.
+var algorithmSalt = []byte("faraway-test/protocol") //nolint:gochecknoglobals // constant salt
+
+// Algorithm represents the hash function a Proof of Work puzzle is built on.
+// Server and client select an implementation by its name, so the name must identify the parameters as well.
+type Algorithm interface {
+	// Name returns the unique name the algorithm is announced with
+	Name() string
+	// Hash returns the 256-bit digest of the data
+	Hash(data []byte) []byte
+}
+
+// algorithms - registry of the known algorithms.
+//
+//nolint:gochecknoglobals // registry is shared by all servers and clients of the process
+var algorithms = struct {
+	sync.RWMutex
+	byName map[string]Algorithm
+}{
+	byName: map[string]Algorithm{
+		SHA256:   sha256Algorithm{},
+		Argon2id: argon2idAlgorithm{},
+		Scrypt:   scryptAlgorithm{},
+	},
+}
+
+// RegisterAlgorithm adds the algorithm to the registry, replacing an algorithm with the same name.
+func RegisterAlgorithm(alg Algorithm) {
+	algorithms.Lock()
+	algorithms.byName[alg.Name()] = alg
+	algorithms.Unlock()
+}
+
+// LookupAlgorithm returns the registered algorithm with the given name.
+func LookupAlgorithm(name string) (Algorithm, error) {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+
+	alg, ok := algorithms.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("LookupAlgorithm: unknown algorithm %q", name)
+	}
+	return alg, nil
+}
+
+// Algorithms returns the sorted names of the registered algorithms.
+func Algorithms() []string {
+	algorithms.RLock()
+	defer algorithms.RUnlock()
+
+	names := make([]string, 0, len(algorithms.byName))
+	for name := range algorithms.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sha256Algorithm - the classic Hashcash puzzle, cheap to verify but easily accelerated by GPUs and ASICs.
+type sha256Algorithm struct{}
+
+func (sha256Algorithm) Name() string { return SHA256 }
+
+func (sha256Algorithm) Hash(data []byte) []byte {
+	checksum := sha256.Sum256(data)
+	return checksum[:]
+}
+
+// argon2idAlgorithm - memory-hard puzzle, every hash requires argon2Memory KiB of memory.
+type argon2idAlgorithm struct{}
+
+func (argon2idAlgorithm) Name() string { return Argon2id }
+
+func (argon2idAlgorithm) Hash(data []byte) []byte {
+	return argon2.IDKey(data, algorithmSalt, argon2Time, argon2Memory, argon2Threads, sha256.Size)
+}
+
+// scryptAlgorithm - memory-hard puzzle, every hash requires 128 * scryptN * scryptR bytes of memory.
+type scryptAlgorithm struct{}
+
+func (scryptAlgorithm) Name() string { return Scrypt }
+
+func (scryptAlgorithm) Hash(data []byte) []byte {
+	// Parameters are constant and valid, so scrypt never fails
+	key, _ := scrypt.Key(data, algorithmSalt, scryptN, scryptR, scryptP, sha256.Size)
+	return key
+}
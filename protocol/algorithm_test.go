@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testAlgorithm struct{}
+
+func (testAlgorithm) Name() string { return "test" }
+
+func (testAlgorithm) Hash(data []byte) []byte { return sha256Algorithm{}.Hash(append(data, 't')) }
+
+func TestLookupAlgorithm(t *testing.T) {
+	for _, name := range []string{SHA256, Argon2id, Scrypt} {
+		alg, err := LookupAlgorithm(name)
+		require.NoError(t, err)
+		require.Equal(t, name, alg.Name())
+		require.Len(t, alg.Hash([]byte("data")), hashBitLen/8)
+		require.Equal(t, alg.Hash([]byte("data")), alg.Hash([]byte("data")))
+		require.NotEqual(t, alg.Hash([]byte("data")), alg.Hash([]byte("atad")))
+	}
+
+	_, err := LookupAlgorithm("test")
+	require.Error(t, err)
+
+	RegisterAlgorithm(testAlgorithm{})
+	alg, err := LookupAlgorithm("test")
+	require.NoError(t, err)
+	require.Equal(t, testAlgorithm{}, alg)
+	require.Contains(t, Algorithms(), "test")
+}
+
+func TestProofOfWork_Algorithms(t *testing.T) {
+	for _, name := range []string{SHA256, Argon2id, Scrypt} {
+		alg, err := LookupAlgorithm(name)
+		require.NoError(t, err)
+		pow := NewProofOfWork(4, time.Second*10, WithAlgorithm(alg))
+		require.Equal(t, name, pow.Algorithm().Name())
+
+		server, client := net.Pipe()
+		go pow.SolveChallenge(client)
+
+		err = pow.ChallengeResponse(server, []byte("127.0.0.1"))
+		require.NoError(t, err)
+	}
+}
+
+func TestServer_ServeAlgorithm(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Test quote"
+
+	server := NewServer(logger.Sugar(), NewProofOfWork(4, time.Second*10, WithAlgorithm(argon2idAlgorithm{})), time.Second*60,
+		func(ctx context.Context, request *Request) (*Response, error) {
+			response := Response(testQuote)
+			return &response, nil
+		})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	require.Equal(t, Argon2id, c.crProto.(*ProofOfWork).Algorithm().Name())
+
+	quote, err := c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, testQuote, quote)
+}
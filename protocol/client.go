@@ -2,84 +2,452 @@ package protocol
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
 	"math/big"
 	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 type clientChallengeResponse interface {
-	SolveChallenge(net.Conn) error
+	SolveChallenge(net.Conn) error                                                          // Method for solving a challenge read from the connection
+	readChallenge(reader *bufio.Reader) (*challenge, error)                                 // Method for reading a challenge
+	parseChallenge(payload []byte) (*challenge, error)                                      // Method for reading a challenge from a challenge frame
+	parseChallengeParams(payload []byte) (*challenge, error)                                // Method for reading a challenge announcing its parameters from a challenge frame
+	solveContext(ctx context.Context, chal *challenge, cfg SolverConfig) (*response, error) // Method for solving a challenge in parallel
 }
 
-// Client for interaction with protocol Quote server.
+// Client for interaction with protocol Quote server. It is safe for concurrent use: since MultiplexVersion
+// the requests of several goroutines are in flight at once, before that they are made one at a time.
 type Client struct {
+	// mu guards the fields below. It is held for the whole exchange of a request made one at a time
+	mu sync.Mutex
 	// Network connection associated with the client
 	conn net.Conn
 	// Challenge-response protocol implementation
 	crProto clientChallengeResponse
+	// solution - solved challenge whose response has not been received yet.
+	// It is redeemed instead of solving a new challenge after Reconnect.
+	solution *response
+	// access - access token granted by the server, attached to the requests until it is exhausted.
+	// It is kept after Reconnect.
+	access *accessGrant
+	// solver - configuration of the parallel solver
+	solver SolverConfig
+	// legacy - the SYN/ACK handshake of version 0 is used instead of HELLO/WELCOME
+	legacy bool
+	// clientID - ID of the client sent in HELLO, empty if none
+	clientID string
+	// session - parameters negotiated by the handshake
+	session Session
+	// enc, dec - frame encoder and decoder of the connection, used since FramedVersion
+	enc *Encoder
+	dec *Decoder
+	// mux - multiplexer of the requests in flight, used since MultiplexVersion
+	mux *clientMux
+}
+
+// ClientOption configures optional features of the client.
+type ClientOption func(*Client)
+
+// WithSolver sets the configuration of the parallel solver used for challenges.
+func WithSolver(cfg SolverConfig) ClientOption {
+	return func(c *Client) {
+		c.solver = cfg
+	}
+}
+
+// WithLegacyHandshake makes the client use the SYN/ACK handshake of version 0 for servers
+// not supporting the HELLO/WELCOME one.
+func WithLegacyHandshake() ClientOption {
+	return func(c *Client) {
+		c.legacy = true
+	}
+}
+
+// WithClientID sets the ID sent to the server in HELLO, up to 64 bytes. The server tracks the reputation
+// of clients with an ID apart from the other clients sharing their address.
+func WithClientID(id string) ClientOption {
+	return func(c *Client) {
+		c.clientID = id
+	}
 }
 
 // NewClient creates a new client instance with the given network connection.
-func NewClient(conn net.Conn) (*Client, error) {
+func NewClient(conn net.Conn, opts ...ClientOption) (*Client, error) {
+	return NewClientContext(context.Background(), conn, opts...)
+}
+
+// NewClientContext creates a new client instance with the given network connection.
+// The handshake is interrupted when ctx is done.
+func NewClientContext(ctx context.Context, conn net.Conn, opts ...ClientOption) (*Client, error) {
 	c := &Client{conn: conn}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	err := c.withContext(ctx, c.handshake)
+	if err != nil {
+		return nil, fmt.Errorf("NewClientContext - handshake: %w", err)
+	}
+
+	return c, nil
+}
+
+// Reconnect replaces the connection of the client with a new one and performs the handshake on it.
+// A challenge solved on the previous connection, whose response was lost, is redeemed with the next request,
+// and the access token granted on it is attached to the following ones.
+func (c *Client) Reconnect(conn net.Conn) error {
+	return c.ReconnectContext(context.Background(), conn)
+}
+
+// ReconnectContext replaces the connection of the client with a new one and performs the handshake on it.
+// The handshake is interrupted when ctx is done.
+func (c *Client) ReconnectContext(ctx context.Context, conn net.Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_ = c.conn.Close()
+	c.conn = conn
+	c.crProto = nil
+
+	err := c.withContext(ctx, c.handshake)
+	if err != nil {
+		return fmt.Errorf("ReconnectContext - handshake: %w", err)
+	}
+	return nil
+}
 
+// withContext applies the deadline of ctx to the connection while fn runs and interrupts fn when ctx is done.
+// The connection is closed if fn is interrupted, since the exchange with the server is left incomplete.
+func (c *Client) withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = c.conn.SetDeadline(deadline)
+	}
+	stop := interruptOnDone(ctx, c.conn)
+
+	err := fn()
+	stop()
+	if deadline, ok := ctx.Deadline(); ok && err != nil && !time.Now().Before(deadline) {
+		// The connection may reach the deadline slightly before ctx does
+		<-ctx.Done()
+	}
+	if err != nil && ctx.Err() != nil {
+		_ = c.conn.Close()
+		if !errors.Is(err, ctx.Err()) {
+			err = fmt.Errorf("%w: %v", ctx.Err(), err)
+		}
+		return err
+	}
+
+	_ = c.conn.SetDeadline(time.Time{})
+	return err
+}
+
+// Session returns the parameters of the connection negotiated by the handshake.
+func (c *Client) Session() Session {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+// handshake establishes the connection and selects the challenge-response protocol.
+func (c *Client) handshake() error {
+	c.enc, c.dec, c.mux = nil, nil, nil
+	if c.legacy {
+		return c.legacyHandshake()
+	}
+
+	err := c.hello()
+	if err != nil {
+		return err
+	}
+	if c.framed() {
+		c.enc = NewEncoder(c.conn, c.session.MaxFrameSize, contains(c.session.Compression, compressionFlate))
+		c.dec = NewDecoder(bufio.NewReader(c.conn), c.session.MaxFrameSize)
+	}
+	if c.session.Version >= MultiplexVersion {
+		c.enc.EnableRequestIDs()
+		c.dec.EnableRequestIDs()
+		c.mux = newClientMux(c.enc, c.dec, c.crProto, c.session.MaxConcurrent)
+	}
+	return nil
+}
+
+// framed reports whether the connection exchanges frames.
+func (c *Client) framed() bool {
+	return c.session.Version >= FramedVersion
+}
+
+// legacyHandshake establishes the connection with the SYN/ACK handshake of version 0,
+// where the difficulty is the difference between ACK and SYN.
+func (c *Client) legacyHandshake() error {
 	// Generate a random SYN value
 	syn, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt8))
 	if err != nil {
-		return nil, fmt.Errorf("NewClient - Int: %v", err)
+		return fmt.Errorf("legacyHandshake - Int: %v", err)
 	}
 
 	// Send the SYN value to the server
 	err = binary.Write(c.conn, binary.LittleEndian, int16(syn.Int64()))
 	if err != nil {
-		return nil, fmt.Errorf("NewClient - Int: %v", err)
+		return fmt.Errorf("legacyHandshake - Write: %v", err)
 	}
 
 	var ack int32
 	// Read the ACK value from the server
 	err = binary.Read(c.conn, binary.LittleEndian, &ack)
 	if err != nil {
-		return nil, fmt.Errorf("NewClient - Read: %v", err)
+		return fmt.Errorf("legacyHandshake - Read: %v", err)
 	}
 
-	// Check if the ACK value matches the SYN value, and if not, initialize the challenge-response protocol
-	if int64(ack) != syn.Int64() {
-		target := big.NewInt(1)
-		target.Lsh(target, hashBitLen-uint(int64(ack)-syn.Int64()))
+	c.session = Session{Version: LegacyVersion, MaxFrameSize: DefaultMaxFrameSize, MaxConcurrent: 1}
 
-		pow := &ProofOfWork{
-			target:     target,
-			targetBits: uint8(int64(ack) - syn.Int64()),
-		}
-		c.crProto = pow
+	// Check if the ACK value matches the SYN value, and if not, initialize the challenge-response protocol,
+	// which is always SHA-256 in version 0
+	if int64(ack) != syn.Int64() {
+		c.session.Complexity = uint8(int64(ack) - syn.Int64())
+		c.session.Algorithm = SHA256
+		c.crProto = NewProofOfWork(c.session.Complexity, 0)
 	}
 
-	return c, nil
+	return nil
 }
 
 // GetQuote sends a request to the server to get a quote.
 func (c *Client) GetQuote() (string, error) {
+	return c.GetQuoteContext(context.Background())
+}
+
+// GetQuoteContext sends a request to the server to get a quote. The request is interrupted when ctx is done,
+// including the parallel solver of the challenge. Before MultiplexVersion the connection is closed in this case,
+// since the server still waits for the solution, and the client must be reconnected. Since then only the request
+// is abandoned.
+func (c *Client) GetQuoteContext(ctx context.Context) (string, error) {
+	quote, err := c.Do(ctx, CmdGetQuote)
+	if err != nil {
+		return "", fmt.Errorf("GetQuoteContext: %w", err)
+	}
+	return quote, nil
+}
+
+// Do sends the command with its arguments to the server and returns the response. Neither the name
+// of the command nor the arguments may contain whitespace. The request is interrupted when ctx is done,
+// as GetQuoteContext describes.
+func (c *Client) Do(ctx context.Context, command string, args ...string) (res string, err error) {
+	for _, word := range append([]string{command}, args...) {
+		if word == "" || strings.IndexFunc(word, unicode.IsSpace) >= 0 {
+			return "", fmt.Errorf("Do: invalid word %q of the request", word)
+		}
+	}
+	req := strings.Join(append([]string{command}, args...), " ")
+
+	c.mu.Lock()
+	if m := c.mux; m != nil {
+		c.mu.Unlock()
+		var payload []byte
+		payload, err = c.call(ctx, m, []byte(req))
+		res = string(payload)
+	} else {
+		err = c.withContext(ctx, func() error {
+			res, err = c.do(ctx, req)
+			return err
+		})
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return "", fmt.Errorf("Do: %w", err)
+	}
+	return res, nil
+}
+
+// do exchanges the request and its response with the server.
+func (c *Client) do(ctx context.Context, req string) (string, error) {
+	if c.framed() {
+		res, err := c.roundTrip(ctx, []byte(req))
+		if err != nil {
+			return "", fmt.Errorf("do - roundTrip: %w", err)
+		}
+		return string(res), nil
+	}
+
 	// Send the request to the server
-	_, err := c.conn.Write([]byte(fmt.Sprint("GetQuote", "\n")))
+	_, err := c.conn.Write([]byte(fmt.Sprint(req, "\n")))
 	if err != nil {
-		return "", fmt.Errorf("GetQuote - Write: %v", err)
+		return "", fmt.Errorf("do - Write: %v", err)
 	}
 
+	reader := bufio.NewReader(c.conn)
+
 	// Solve the challenge if the challenge-response protocol is implemented
+	var redeemed bool
 	if c.crProto != nil {
-		err = c.crProto.SolveChallenge(c.conn)
+		redeemed, err = c.respond(ctx, reader)
 		if err != nil {
-			return "", fmt.Errorf("GetQuote - SolveChallenge: %v", err)
+			return "", fmt.Errorf("do - respond: %w", err)
 		}
 	}
 
-	// Read the quote from the server
-	quote, err := bufio.NewReader(c.conn).ReadSlice('\n')
+	// Read the response from the server
+	res, err := reader.ReadSlice('\n')
 	if err != nil {
-		return "", fmt.Errorf("GetQuote - ReadSlice: %v", err)
+		// A fresh solution may be redeemed after reconnecting, a redeemed one has been rejected
+		if redeemed {
+			c.solution = nil
+		}
+		return "", fmt.Errorf("do - ReadSlice: %v", err)
+	}
+	c.solution = nil
+	return string(res[:len(res)-1]), nil
+}
+
+// roundTrip sends the request frame and returns the payload of the response frame.
+// The challenge the server sends meanwhile is answered with a solution frame, the access token it grants
+// after the solution is attached to the following requests.
+func (c *Client) roundTrip(ctx context.Context, req []byte) ([]byte, error) {
+	frame := &Frame{Type: FrameRequest, Payload: req}
+	token := c.accessToken()
+	if token != nil {
+		payload, err := attachAccessToken(token, req)
+		if err != nil {
+			return nil, fmt.Errorf("roundTrip - attachAccessToken: %v", err)
+		}
+		frame.Flags, frame.Payload = FlagAccessToken, payload
+	}
+	err := c.enc.Encode(frame)
+	if err != nil {
+		return nil, fmt.Errorf("roundTrip - Encode: %v", err)
+	}
+
+	var redeemed bool
+	for {
+		f, err := c.dec.Decode()
+		if err != nil {
+			// A fresh solution may be redeemed after reconnecting, a redeemed one has been rejected
+			if redeemed {
+				c.solution = nil
+			}
+			return nil, fmt.Errorf("roundTrip - Decode: %w", err)
+		}
+
+		switch f.Type {
+		case FrameChallenge:
+			if c.crProto == nil {
+				return nil, fmt.Errorf("roundTrip: challenge received, but PoW is disabled")
+			}
+			// The server has not accepted the access token
+			if token != nil {
+				c.access = nil
+			}
+			// The complexity and the hash function of the challenge are announced with it since ChallengeParamsVersion,
+			// before that they are taken from its token and the handshake
+			parse := c.crProto.parseChallenge
+			if c.session.Version >= ChallengeParamsVersion {
+				parse = c.crProto.parseChallengeParams
+			}
+			chal, err := parse(f.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("roundTrip - parseChallenge: %v", err)
+			}
+			redeemed, err = c.solve(ctx, chal)
+			if err != nil {
+				return nil, fmt.Errorf("roundTrip - solve: %w", err)
+			}
+			err = c.enc.Encode(&Frame{Type: FrameSolution, Payload: c.solution.payload()})
+			if err != nil {
+				return nil, fmt.Errorf("roundTrip - Encode: %v", err)
+			}
+		case FrameAccess:
+			c.access, err = parseAccessGrant(f.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("roundTrip - parseAccessGrant: %v", err)
+			}
+		case FrameResponse:
+			c.solution = nil
+			return f.Payload, nil
+		case FrameError:
+			if redeemed {
+				c.solution = nil
+			}
+			serverErr, err := parseServerError(f.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("roundTrip - parseServerError: %v", err)
+			}
+			return nil, fmt.Errorf("roundTrip: %w", serverErr)
+		case FramePing:
+			if f.Flags&FlagAck == 0 {
+				err = c.enc.Encode(&Frame{Type: FramePing, Flags: FlagAck, ID: f.ID, Payload: f.Payload})
+				if err != nil {
+					return nil, fmt.Errorf("roundTrip - Encode: %v", err)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("roundTrip: unexpected %s frame", f.Type)
+		}
+	}
+}
+
+// accessToken returns the access token to attach to the next request, or nil if there is none or it is exhausted.
+func (c *Client) accessToken() []byte {
+	if c.access == nil || c.session.Version < AccessTokenVersion {
+		return nil
+	}
+	if c.access.remaining <= 0 || !time.Now().Before(c.access.expires) {
+		c.access = nil
+		return nil
+	}
+	c.access.remaining--
+	return c.access.token
+}
+
+// respond answers the challenge of the server with the pending solution, if it has not expired yet,
+// or with the solution of the received challenge.
+func (c *Client) respond(ctx context.Context, reader *bufio.Reader) (redeemed bool, err error) {
+	chal, err := c.crProto.readChallenge(reader)
+	if err != nil {
+		return false, fmt.Errorf("respond - readChallenge: %v", err)
+	}
+
+	// Servers of version 0 verify the solution of the challenge just issued, which is sent without the token
+	legacy := c.session.Version == LegacyVersion
+	if legacy {
+		c.solution = nil
+	}
+	redeemed, err = c.solve(ctx, chal)
+	if err != nil {
+		return false, fmt.Errorf("respond - solve: %w", err)
+	}
+
+	msg := c.solution.marshal()
+	if legacy {
+		msg = c.solution.legacyMarshal()
+	}
+	_, err = c.conn.Write(msg)
+	if err != nil {
+		return redeemed, fmt.Errorf("respond - Write: %v", err)
+	}
+	return redeemed, nil
+}
+
+// solve sets the solution of the challenge: the pending solution, if it has not expired yet,
+// or the solution of the received challenge found by the parallel solver.
+func (c *Client) solve(ctx context.Context, chal *challenge) (redeemed bool, err error) {
+	redeemed = c.solution != nil && !c.solution.expired()
+	if !redeemed {
+		c.solution, err = c.crProto.solveContext(ctx, chal, c.solver)
+		if err != nil {
+			return false, fmt.Errorf("solve - solveContext: %w", err)
+		}
 	}
-	return string(quote[:len(quote)-1]), nil
+	return redeemed, nil
 }
@@ -0,0 +1,48 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// aLongTimeAgo - non-zero time in the past, used as a deadline to interrupt blocked I/O.
+//
+//nolint:gochecknoglobals // immutable value
+var aLongTimeAgo = time.Unix(1, 0)
+
+// interruptOnDone interrupts blocked and further I/O on the connection once ctx is done.
+// The returned function stops watching ctx and waits for the watcher to exit.
+func interruptOnDone(ctx context.Context, conn net.Conn) (stop func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	stopc := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(aLongTimeAgo)
+		case <-stopc:
+		}
+	}()
+
+	return func() {
+		close(stopc)
+		<-done
+	}
+}
+
+// readDeadline returns the earliest of the deadline of ctx and now plus timeout. Zero timeout means no timeout.
+func readDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
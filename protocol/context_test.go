@@ -0,0 +1,63 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ServeContext(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	canceled := make(chan error, 1)
+
+	server := NewServer(logger.Sugar(), nil, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.ServeContext(ctx, l) }()
+
+	// The request is canceled when the peer disconnects
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	err = c.enc.Encode(&Frame{Type: FrameRequest, Payload: []byte("GetQuote")})
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	select {
+	case err = <-canceled:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not canceled")
+	}
+
+	// Cancellation of the root context stops the server
+	cancel()
+	select {
+	case err = <-served:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server was not stopped")
+	}
+}
+
+func TestClient_NewClientContext(t *testing.T) {
+	// The server never answers the handshake
+	server, client := net.Pipe()
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := NewClientContext(ctx, client)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// complexityAdjuster is implemented by challenge-response protocols whose complexity can be changed at runtime.
+type complexityAdjuster interface {
+	SetDifficulty(bits float64) // Method to set the difficulty of the protocol in bits
+	DifficultyStep() float64    // Method to get the bits the complexity is changed by at once
+	Difficulty() float64        // Method to get the current difficulty of the protocol in bits
+}
+
+// ControllerConfig represents the configuration of the adaptive difficulty controller.
+// A zero high watermark disables the corresponding load signal.
+type ControllerConfig struct {
+	// MinComplexity - the lowest complexity the controller may set
+	MinComplexity int
+	// MaxComplexity - the highest complexity the controller may set
+	MaxComplexity int
+	// Interval between two evaluations of the load signals
+	Interval time.Duration
+
+	// HighConnections - number of active connections above which complexity is increased
+	HighConnections int64
+	// LowConnections - number of active connections below which complexity may be decreased
+	LowConnections int64
+	// HighAcceptRate - accepted connections per second above which complexity is increased
+	HighAcceptRate float64
+	// LowAcceptRate - accepted connections per second below which complexity may be decreased
+	LowAcceptRate float64
+	// HighFailureRate - failed challenges per second above which complexity is increased
+	HighFailureRate float64
+	// LowFailureRate - failed challenges per second below which complexity may be decreased
+	LowFailureRate float64
+}
+
+// Controller adapts the complexity of the challenge-response protocol to the load of the server.
+// Complexity is increased as soon as any signal reaches its high watermark and decreased only when
+// every signal has fallen to its low watermark, which keeps the difficulty from flapping.
+type Controller struct {
+	// Logger for logging complexity changes
+	logger *zap.SugaredLogger
+	// Challenge-response protocol whose complexity is adjusted
+	adjuster complexityAdjuster
+	// Controller configuration
+	cfg ControllerConfig
+
+	// active - number of currently served connections
+	active atomic.Int64
+	// accepted - number of connections accepted since the last evaluation
+	accepted atomic.Uint64
+	// failed - number of failed challenges since the last evaluation
+	failed atomic.Uint64
+}
+
+// NewController creates a new adaptive difficulty controller.
+func NewController(logger *zap.SugaredLogger, adjuster complexityAdjuster, cfg ControllerConfig) *Controller {
+	return &Controller{logger: logger, adjuster: adjuster, cfg: cfg}
+}
+
+// Bounds returns the lowest and the highest complexity the controller may set. The controller clamps the
+// complexity it steps to them, and moves a complexity set outside of them back by a step every interval.
+func (c *Controller) Bounds() (minComplexity, maxComplexity int) {
+	return c.cfg.MinComplexity, c.cfg.MaxComplexity
+}
+
+// Run evaluates the load signals every cfg.Interval until stop is closed.
+func (c *Controller) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.adjust(now.Sub(last))
+			last = now
+		}
+	}
+}
+
+// connOpened records an accepted connection.
+func (c *Controller) connOpened() {
+	c.active.Add(1)
+	c.accepted.Add(1)
+}
+
+// connClosed records a finished connection.
+func (c *Controller) connClosed() {
+	c.active.Add(-1)
+}
+
+// challengeFailed records a failed challenge.
+func (c *Controller) challengeFailed() {
+	c.failed.Add(1)
+}
+
+// adjust compares the signals collected during elapsed with the watermarks and changes the complexity by one step.
+func (c *Controller) adjust(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	if seconds <= 0 {
+		return
+	}
+
+	active := c.active.Load()
+	acceptRate := float64(c.accepted.Swap(0)) / seconds
+	failureRate := float64(c.failed.Swap(0)) / seconds
+
+	// A fractional complexity or step is clamped to the bounds, so it is not stepped past them and back
+	complexity, step := c.adjuster.Difficulty(), c.adjuster.DifficultyStep()
+	minComplexity, maxComplexity := float64(c.cfg.MinComplexity), float64(c.cfg.MaxComplexity)
+	switch {
+	case complexity < minComplexity,
+		complexity < maxComplexity && c.overloaded(active, acceptRate, failureRate):
+		c.adjuster.SetDifficulty(math.Min(complexity+step, maxComplexity))
+	case complexity > maxComplexity,
+		complexity > minComplexity && c.relaxed(active, acceptRate, failureRate):
+		c.adjuster.SetDifficulty(math.Max(complexity-step, minComplexity))
+	default:
+		return
+	}
+
+	c.logger.Infof("protocol: complexity changed from %g to %g (active: %d, accept rate: %.2f/s, failure rate: %.2f/s)",
+		complexity, c.adjuster.Difficulty(), active, acceptRate, failureRate)
+}
+
+// overloaded reports whether any enabled signal has reached its high watermark.
+func (c *Controller) overloaded(active int64, acceptRate, failureRate float64) bool {
+	return (c.cfg.HighConnections > 0 && active >= c.cfg.HighConnections) ||
+		(c.cfg.HighAcceptRate > 0 && acceptRate >= c.cfg.HighAcceptRate) ||
+		(c.cfg.HighFailureRate > 0 && failureRate >= c.cfg.HighFailureRate)
+}
+
+// relaxed reports whether every enabled signal has fallen to its low watermark.
+// Without any enabled signal the controller only keeps the complexity within bounds.
+func (c *Controller) relaxed(active int64, acceptRate, failureRate float64) bool {
+	if c.cfg.HighConnections == 0 && c.cfg.HighAcceptRate == 0 && c.cfg.HighFailureRate == 0 {
+		return false
+	}
+	return (c.cfg.HighConnections == 0 || active <= c.cfg.LowConnections) &&
+		(c.cfg.HighAcceptRate == 0 || acceptRate <= c.cfg.LowAcceptRate) &&
+		(c.cfg.HighFailureRate == 0 || failureRate <= c.cfg.LowFailureRate)
+}
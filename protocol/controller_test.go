@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestController_Adjust(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(10, 0)
+	controller := NewController(logger.Sugar(), pow, ControllerConfig{
+		MinComplexity:   8,
+		MaxComplexity:   12,
+		Interval:        time.Second,
+		HighConnections: 10,
+		LowConnections:  2,
+		HighFailureRate: 5,
+		LowFailureRate:  1,
+	})
+
+	// Between the watermarks complexity holds
+	for i := 0; i < 5; i++ {
+		controller.connOpened()
+	}
+	controller.adjust(time.Second)
+	require.Equal(t, 10, pow.GetComplexity())
+
+	// Any signal at its high watermark increases complexity up to the max
+	for i := 0; i < 5; i++ {
+		controller.connOpened()
+	}
+	for i := 0; i < 5; i++ {
+		controller.adjust(time.Second)
+	}
+	require.Equal(t, 12, pow.GetComplexity())
+
+	// Connections are low, but failures are still high, so complexity holds
+	for i := 0; i < 9; i++ {
+		controller.connClosed()
+	}
+	for i := 0; i < 3; i++ {
+		controller.challengeFailed()
+	}
+	controller.adjust(time.Second)
+	require.Equal(t, 12, pow.GetComplexity())
+
+	// All signals are low, complexity decreases down to the min
+	for i := 0; i < 5; i++ {
+		controller.adjust(time.Second)
+	}
+	require.Equal(t, 8, pow.GetComplexity())
+
+	// Failure rate alone reaches the high watermark
+	for i := 0; i < 10; i++ {
+		controller.challengeFailed()
+	}
+	controller.adjust(2 * time.Second)
+	require.Equal(t, 9, pow.GetComplexity())
+}
+
+func TestController_Bounds(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(2, 0)
+	controller := NewController(logger.Sugar(), pow, ControllerConfig{
+		MinComplexity: 4,
+		MaxComplexity: 6,
+		Interval:      time.Second,
+	})
+
+	for i := 0; i < 5; i++ {
+		controller.adjust(time.Second)
+	}
+	require.Equal(t, 4, pow.GetComplexity())
+
+	pow = NewProofOfWork(9, 0)
+	controller = NewController(logger.Sugar(), pow, ControllerConfig{
+		MinComplexity: 4,
+		MaxComplexity: 6,
+		Interval:      time.Second,
+	})
+	for i := 0; i < 5; i++ {
+		controller.adjust(time.Second)
+	}
+	require.Equal(t, 6, pow.GetComplexity())
+}
+
+func TestController_FractionalStep(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(0, 0, WithDifficulty(19.5), WithDifficultyStep(0.75))
+	controller := NewController(logger.Sugar(), pow, ControllerConfig{
+		MinComplexity:   18,
+		MaxComplexity:   20,
+		Interval:        time.Second,
+		HighConnections: 2,
+		LowConnections:  0,
+	})
+
+	// Under sustained load the complexity stops at the max instead of stepping past it and back
+	controller.connOpened()
+	controller.connOpened()
+	for i := 0; i < 5; i++ {
+		controller.adjust(time.Second)
+		require.Equal(t, float64(20), pow.Difficulty())
+	}
+
+	// Once the load is gone it steps down to the min and stays there
+	controller.connClosed()
+	controller.connClosed()
+	controller.adjust(time.Second)
+	require.Equal(t, 19.25, pow.Difficulty())
+	controller.adjust(time.Second)
+	require.Equal(t, 18.5, pow.Difficulty())
+	for i := 0; i < 5; i++ {
+		controller.adjust(time.Second)
+		require.Equal(t, float64(18), pow.Difficulty())
+	}
+}
+
+func TestProofOfWork_Complexity(t *testing.T) {
+	pow := NewProofOfWork(1, 0)
+	pow.DecreaseComplexity()
+	pow.DecreaseComplexity()
+	require.Equal(t, 0, pow.GetComplexity())
+
+	pow.IncreaseComplexity()
+	pow.IncreaseComplexity()
+	require.Equal(t, 2, pow.GetComplexity())
+
+	expected := NewProofOfWork(2, 0)
+	require.Zero(t, expected.target.Cmp(pow.target))
+}
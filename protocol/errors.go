@@ -0,0 +1,156 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"time"
+)
+
+// errorPayloadLen - length of the fixed part of the payload of an error frame: code uint16 and retry-after uint32.
+const errorPayloadLen = 6
+
+// ErrorCode represents the reason of an error frame.
+type ErrorCode uint16
+
+const (
+	// CodeInternal - the server failed to handle the request
+	CodeInternal ErrorCode = iota + 1
+	// CodeBadRequest - the client sent a malformed or unexpected message
+	CodeBadRequest
+	// CodeInvalidSolution - the solution of the challenge is wrong or does not match the client
+	CodeInvalidSolution
+	// CodeChallengeExpired - the solution was received after the challenge expired
+	CodeChallengeExpired
+	// CodeChallengeReplayed - the solution has already been accepted
+	CodeChallengeReplayed
+	// CodeTimeout - the solution was not received within the read timeout
+	CodeTimeout
+	// CodeServerBusy - the server refuses the request because of its load, the client should retry later
+	CodeServerBusy
+	// CodeUnknownCommand - no handler is registered for the command of the request
+	CodeUnknownCommand
+	// CodeNotFound - the object requested by the command does not exist
+	CodeNotFound
+	// CodeRequestTimeout - the request was not handled within the time limit of the server
+	CodeRequestTimeout
+)
+
+var (
+	// ErrInvalidSolution is returned when the solution of the challenge is wrong or does not match the client.
+	ErrInvalidSolution = &PowError{"response is not valid"}
+	// ErrChallengeTimeout is returned when the solution was not received within the read timeout.
+	ErrChallengeTimeout = &PowError{"challenge response timed out"}
+	// ErrServerBusy is returned when the server refuses the request because of its load.
+	ErrServerBusy = errors.New("protocol: server is busy")
+	// ErrBadRequest is returned when the server received a malformed or unexpected message.
+	ErrBadRequest = errors.New("protocol: bad request")
+	// ErrInternal is returned when the server failed to handle the request.
+	ErrInternal = errors.New("protocol: internal server error")
+	// ErrUnknownCommand is returned when no handler is registered for the command of the request.
+	ErrUnknownCommand = errors.New("protocol: unknown command")
+	// ErrNotFound is returned when the object requested by the command does not exist.
+	ErrNotFound = errors.New("protocol: not found")
+	// ErrRequestTimeout is returned when the request was not handled within the time limit of the server.
+	ErrRequestTimeout = errors.New("protocol: request timed out")
+)
+
+// errorCodes maps the sentinel errors to the codes of error frames.
+//
+//nolint:gochecknoglobals // immutable lookup table
+var errorCodes = map[error]ErrorCode{
+	ErrInternal:          CodeInternal,
+	ErrBadRequest:        CodeBadRequest,
+	ErrInvalidSolution:   CodeInvalidSolution,
+	ErrChallengeExpired:  CodeChallengeExpired,
+	ErrChallengeReplayed: CodeChallengeReplayed,
+	ErrChallengeTimeout:  CodeTimeout,
+	ErrServerBusy:        CodeServerBusy,
+	ErrUnknownCommand:    CodeUnknownCommand,
+	ErrNotFound:          CodeNotFound,
+	ErrRequestTimeout:    CodeRequestTimeout,
+}
+
+// ServerError represents an error frame received from the server. It matches the sentinel error
+// of its code with errors.Is, such as ErrInvalidSolution or ErrServerBusy.
+type ServerError struct {
+	// Code - reason of the error
+	Code ErrorCode
+	// RetryAfter - time after which the request may succeed, zero if retrying does not help
+	RetryAfter time.Duration
+	// Message - human readable description of the error
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("server error %d: %s (retry after %v)", e.Code, e.Message, e.RetryAfter)
+	}
+	return fmt.Sprintf("server error %d: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is the sentinel error of the code.
+func (e *ServerError) Is(target error) bool {
+	code, ok := errorCodes[target]
+	return ok && code == e.Code
+}
+
+// NewServerError creates the error sent to the client when err interrupts a request.
+// Handlers may return a ServerError, or wrap a sentinel error such as ErrNotFound, to describe the error
+// to the client. Other errors of the handler are hidden behind ErrInternal.
+func NewServerError(err error) *ServerError {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr
+	}
+
+	for sentinel, code := range errorCodes {
+		if sentinel != ErrInternal && errors.Is(err, sentinel) {
+			return &ServerError{Code: code, Message: sentinel.Error()}
+		}
+	}
+	if errors.Is(err, ErrFrameTooLarge) {
+		return &ServerError{Code: CodeBadRequest, Message: ErrFrameTooLarge.Error()}
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return &ServerError{Code: CodeTimeout, Message: ErrChallengeTimeout.Error()}
+	}
+	return &ServerError{Code: CodeInternal, Message: ErrInternal.Error()}
+}
+
+// recoverable reports whether the request failed without disturbing the connection, so the client may send
+// the next request on it.
+func (e *ServerError) recoverable() bool {
+	switch e.Code {
+	case CodeBadRequest, CodeUnknownCommand, CodeNotFound:
+		return true
+	}
+	return false
+}
+
+// marshal returns the payload of the error frame: code uint16, retry-after uint32 in milliseconds and the message.
+func (e *ServerError) marshal() []byte {
+	retryAfter := e.RetryAfter.Milliseconds()
+	if retryAfter > math.MaxUint32 {
+		retryAfter = math.MaxUint32
+	}
+	b := make([]byte, 0, errorPayloadLen+len(e.Message))
+	b = binary.BigEndian.AppendUint16(b, uint16(e.Code))
+	b = binary.BigEndian.AppendUint32(b, uint32(retryAfter))
+	return append(b, e.Message...)
+}
+
+// parseServerError reads the error from the payload of an error frame.
+func parseServerError(payload []byte) (*ServerError, error) {
+	if len(payload) < errorPayloadLen {
+		return nil, fmt.Errorf("parseServerError: truncated error")
+	}
+	return &ServerError{
+		Code:       ErrorCode(binary.BigEndian.Uint16(payload)),
+		RetryAfter: time.Duration(binary.BigEndian.Uint32(payload[2:])) * time.Millisecond,
+		Message:    string(payload[errorPayloadLen:]),
+	}, nil
+}
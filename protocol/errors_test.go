@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerError(t *testing.T) {
+	busy := &ServerError{Code: CodeServerBusy, RetryAfter: 1500 * time.Millisecond, Message: "too many connections"}
+	parsed, err := parseServerError(busy.marshal())
+	require.NoError(t, err)
+	require.Equal(t, busy, parsed)
+	require.ErrorIs(t, fmt.Errorf("GetQuote: %w", parsed), ErrServerBusy)
+	require.NotErrorIs(t, parsed, ErrInternal)
+
+	_, err = parseServerError([]byte{0, 1})
+	require.Error(t, err)
+
+	for _, test := range []struct {
+		err      error
+		sentinel error
+	}{
+		{fmt.Errorf("verify: %w", ErrInvalidSolution), ErrInvalidSolution},
+		{ErrChallengeExpired, ErrChallengeExpired},
+		{ErrChallengeReplayed, ErrChallengeReplayed},
+		{fmt.Errorf("readFrame: %w", os.ErrDeadlineExceeded), ErrChallengeTimeout},
+		{fmt.Errorf("Decode: %w", ErrFrameTooLarge), ErrBadRequest},
+		{busy, ErrServerBusy},
+		{errors.New("database is locked"), ErrInternal},
+	} {
+		serverErr := NewServerError(test.err)
+		require.ErrorIs(t, serverErr, test.sentinel, test.err.Error())
+		require.NotContains(t, serverErr.Message, "database")
+	}
+}
+
+func TestClient_ServerErrors(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(8, time.Second*10, WithSecret([]byte("secret")))
+	var failing atomic.Bool
+	failing.Store(true)
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		if failing.Load() {
+			return nil, errors.New("database is locked")
+		}
+		response := Response("Test quote")
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+
+	_, err = c.GetQuote()
+	require.ErrorIs(t, err, ErrInternal)
+
+	// A solution of a challenge signed by another server is rejected
+	failing.Store(false)
+	stranger := NewProofOfWork(8, 0, WithSecret([]byte("another secret")))
+	chal, err := stranger.newChallenge([]byte("127.0.0.1"))
+	require.NoError(t, err)
+	c.solution, err = stranger.solve(chal)
+	require.NoError(t, err)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, c.Reconnect(conn))
+	_, err = c.GetQuote()
+	require.ErrorIs(t, err, ErrInvalidSolution)
+	require.Nil(t, c.solution)
+
+	var serverErr *ServerError
+	require.ErrorAs(t, err, &serverErr)
+	require.Equal(t, CodeInvalidSolution, serverErr.Code)
+}
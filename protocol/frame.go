@@ -0,0 +1,230 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	// frameHeaderLen - length of the frame header: payload length uint32, type uint8 and flags uint8.
+	frameHeaderLen = 6
+	// frameIDLen - length of the request ID uint32 following the frame header since MultiplexVersion.
+	frameIDLen = 4
+	// compressThreshold - payloads shorter than this are never compressed.
+	compressThreshold = 512
+	// compressionFlate - name of the flate compression negotiated by the handshake.
+	compressionFlate = "flate"
+)
+
+// FrameType represents the kind of message carried by a frame.
+type FrameType uint8
+
+const (
+	// FrameRequest - request of the client
+	FrameRequest FrameType = iota + 1
+	// FrameResponse - response of the server to the request
+	FrameResponse
+	// FrameChallenge - PoW challenge the server sends before handling the request
+	FrameChallenge
+	// FrameSolution - solution of the challenge sent by the client
+	FrameSolution
+	// FrameError - error of the server, the connection is closed after it
+	FrameError
+	// FramePing - keepalive, answered by a ping with FlagAck and the same payload
+	FramePing
+	// FrameAccess - access token granted after a solved challenge, sent since AccessTokenVersion
+	FrameAccess
+)
+
+// String returns the name of the frame type.
+func (t FrameType) String() string {
+	switch t {
+	case FrameRequest:
+		return "REQUEST"
+	case FrameResponse:
+		return "RESPONSE"
+	case FrameChallenge:
+		return "CHALLENGE"
+	case FrameSolution:
+		return "SOLUTION"
+	case FrameError:
+		return "ERROR"
+	case FramePing:
+		return "PING"
+	case FrameAccess:
+		return "ACCESS"
+	default:
+		return fmt.Sprintf("FrameType(%d)", uint8(t))
+	}
+}
+
+// FrameFlags represents the flags of a frame.
+type FrameFlags uint8
+
+const (
+	// FlagAck - the frame answers a frame of the same type, such as a ping
+	FlagAck FrameFlags = 1 << iota
+	// FlagCompressed - the payload is compressed with flate
+	FlagCompressed
+	// FlagAccessToken - the payload of the request is preceded by uint16 length and an access token
+	FlagAccessToken
+)
+
+// ErrFrameTooLarge is returned when a frame exceeds the maximum frame size.
+var ErrFrameTooLarge = errors.New("protocol: frame too large")
+
+// Frame represents a message of the protocol.
+// Frames are encoded as payload length uint32, type uint8, flags uint8, the request ID uint32 if request IDs
+// are enabled, and the payload. The ID tells apart the frames of the requests multiplexed over a connection
+// since MultiplexVersion, frames of the connection itself carry 0.
+type Frame struct {
+	Type    FrameType
+	Flags   FrameFlags
+	ID      uint32
+	Payload []byte
+}
+
+// Encoder writes frames to a stream. It is safe for concurrent use.
+type Encoder struct {
+	w            io.Writer
+	maxFrameSize uint32
+	compress     bool
+	ids          bool
+	// mu serializes the writes of the frames
+	mu sync.Mutex
+}
+
+// NewEncoder creates an encoder of frames of up to maxFrameSize bytes of payload.
+// Payloads worth compressing are compressed with flate if compress is set.
+func NewEncoder(w io.Writer, maxFrameSize uint32, compress bool) *Encoder {
+	return &Encoder{w: w, maxFrameSize: maxFrameSize, compress: compress}
+}
+
+// EnableRequestIDs makes the encoder write the request ID of the frames, as peers do since MultiplexVersion.
+func (e *Encoder) EnableRequestIDs() {
+	e.ids = true
+}
+
+// Encode writes the frame to the stream with a single write.
+// The payload may not exceed the maximum frame size, even if it is compressed.
+func (e *Encoder) Encode(f *Frame) error {
+	if uint64(len(f.Payload)) > uint64(e.maxFrameSize) {
+		return fmt.Errorf("Encode: %w: %s frame of %d bytes", ErrFrameTooLarge, f.Type, len(f.Payload))
+	}
+
+	payload, flags := f.Payload, f.Flags&^FlagCompressed
+	if e.compress && len(payload) >= compressThreshold {
+		compressed, err := deflate(payload)
+		if err != nil {
+			return fmt.Errorf("Encode - deflate: %v", err)
+		}
+		if len(compressed) < len(payload) {
+			payload, flags = compressed, flags|FlagCompressed
+		}
+	}
+
+	buf := make([]byte, frameHeaderLen, frameHeaderLen+frameIDLen+len(payload))
+	binary.BigEndian.PutUint32(buf, uint32(len(payload)))
+	buf[4], buf[5] = byte(f.Type), byte(flags)
+	if e.ids {
+		buf = binary.BigEndian.AppendUint32(buf, f.ID)
+	}
+	buf = append(buf, payload...)
+
+	e.mu.Lock()
+	_, err := e.w.Write(buf)
+	e.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Encode - Write: %w", err)
+	}
+	return nil
+}
+
+// Decoder reads frames from a stream.
+type Decoder struct {
+	r            io.Reader
+	maxFrameSize uint32
+	ids          bool
+}
+
+// NewDecoder creates a decoder of frames of up to maxFrameSize bytes of payload, both compressed and decompressed.
+// The decoder reads no more than the frames it returns, so the stream may be shared with other readers.
+func NewDecoder(r io.Reader, maxFrameSize uint32) *Decoder {
+	return &Decoder{r: r, maxFrameSize: maxFrameSize}
+}
+
+// EnableRequestIDs makes the decoder read the request ID of the frames, as peers do since MultiplexVersion.
+func (d *Decoder) EnableRequestIDs() {
+	d.ids = true
+}
+
+// Decode reads the next frame from the stream.
+func (d *Decoder) Decode() (*Frame, error) {
+	header := make([]byte, frameHeaderLen, frameHeaderLen+frameIDLen)
+	if d.ids {
+		header = header[:frameHeaderLen+frameIDLen]
+	}
+	_, err := io.ReadFull(d.r, header)
+	if err != nil {
+		return nil, fmt.Errorf("Decode - ReadFull: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header)
+	f := &Frame{Type: FrameType(header[4]), Flags: FrameFlags(header[5])}
+	if d.ids {
+		f.ID = binary.BigEndian.Uint32(header[frameHeaderLen:])
+	}
+	if size > d.maxFrameSize {
+		return nil, fmt.Errorf("Decode: %w: %s frame of %d bytes", ErrFrameTooLarge, f.Type, size)
+	}
+
+	f.Payload = make([]byte, size)
+	_, err = io.ReadFull(d.r, f.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("Decode - ReadFull: %w", err)
+	}
+
+	if f.Flags&FlagCompressed != 0 {
+		f.Payload, err = inflate(f.Payload, d.maxFrameSize)
+		if err != nil {
+			return nil, fmt.Errorf("Decode - inflate: %w", err)
+		}
+		f.Flags &^= FlagCompressed
+	}
+	return f, nil
+}
+
+// deflate compresses the data with flate.
+func deflate(data []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w, err := flate.NewWriter(buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(data); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// inflate decompresses the data with flate, failing if the result exceeds maxSize bytes.
+func inflate(data []byte, maxSize uint32) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(out)) > uint64(maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+	return out, nil
+}
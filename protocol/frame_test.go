@@ -0,0 +1,117 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_EncodeDecode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, 1024, true)
+	dec := NewDecoder(buf, 1024)
+
+	frames := []*Frame{
+		{Type: FrameRequest, Payload: []byte("GetQuote")},
+		{Type: FrameResponse, Payload: []byte("multi\nline|quote EOM")},
+		{Type: FramePing, Flags: FlagAck},
+		{Type: FrameResponse, Payload: []byte(strings.Repeat("compressible ", 70))},
+	}
+	for _, f := range frames {
+		require.NoError(t, enc.Encode(f))
+		got, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, f.Type, got.Type)
+		require.Equal(t, f.Flags, got.Flags)
+		require.Equal(t, len(f.Payload), len(got.Payload))
+		if len(f.Payload) > 0 {
+			require.Equal(t, f.Payload, got.Payload)
+		}
+	}
+	require.Zero(t, buf.Len())
+
+	// Neither the payload on the wire nor the decompressed one may exceed the maximum frame size
+	require.ErrorIs(t, enc.Encode(&Frame{Type: FrameResponse, Payload: make([]byte, 2048)}), ErrFrameTooLarge)
+	require.NoError(t, NewEncoder(buf, 4096, false).Encode(&Frame{Type: FrameResponse, Payload: make([]byte, 2048)}))
+	_, err := dec.Decode()
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+
+	buf.Reset()
+	require.NoError(t, NewEncoder(buf, 4096, true).Encode(&Frame{Type: FrameResponse, Payload: make([]byte, 4096)}))
+	_, err = dec.Decode()
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func TestServer_Frames(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Multi-line\nquote | EOM"
+
+	server := NewServer(logger.Sugar(), NewProofOfWork(8, time.Second*10), time.Second*60,
+		func(ctx context.Context, request *Request) (*Response, error) {
+			response := Response(testQuote)
+			return &response, nil
+		})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersion, c.Session().Version)
+	require.Equal(t, []string{compressionFlate}, c.Session().Compression)
+
+	// Pings are answered while the connection is idle
+	require.NoError(t, c.enc.Encode(&Frame{Type: FramePing, Payload: []byte("ping")}))
+	f, err := c.dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, &Frame{Type: FramePing, Flags: FlagAck, Payload: []byte("ping")}, f)
+
+	// Quotes containing delimiters of the line protocol are delivered intact
+	for i := 0; i < 2; i++ {
+		quote, err := c.GetQuote()
+		require.NoError(t, err)
+		require.Equal(t, testQuote, quote)
+	}
+}
+
+func TestClient_ChallengeParams(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(4, time.Second*10)
+	chal, err := pow.issueChallenge([]byte("127.0.0.1"), 7)
+	require.NoError(t, err)
+	payload, err := chal.paramsPayload()
+	require.NoError(t, err)
+	parsed, err := NewProofOfWork(0, 0).parseChallengeParams(payload)
+	require.NoError(t, err)
+	require.Equal(t, chal.data, parsed.data)
+	require.Zero(t, targetFromBits(7).Cmp(parsed.target))
+	require.Equal(t, SHA256, parsed.alg.Name())
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), c.Session().Complexity)
+
+	// The client solves challenges of the complexity announced with them, not the one of the handshake
+	for i := 0; i < 8; i++ {
+		pow.IncreaseComplexity()
+	}
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+}
@@ -0,0 +1,496 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// LegacyVersion - version of the protocol negotiated by the SYN/ACK handshake, where the difficulty
+	// is the difference between ACK and SYN.
+	LegacyVersion uint8 = 0
+	// FramedVersion - the first version of the protocol exchanging length-prefixed frames instead of
+	// newline-terminated requests and EOM-terminated challenges.
+	FramedVersion uint8 = 2
+	// ChallengeParamsVersion - the first version announcing the complexity and the hash function
+	// in every challenge frame, so they may change during the connection.
+	ChallengeParamsVersion uint8 = 3
+	// AccessTokenVersion - the first version granting access tokens, which spare the challenges
+	// of the following requests.
+	AccessTokenVersion uint8 = 4
+	// MultiplexVersion - the first version carrying request IDs in frames, so several requests of a connection
+	// may be in flight at once.
+	MultiplexVersion uint8 = 5
+	// ProtocolVersion - the highest version of the protocol supported by the package.
+	ProtocolVersion uint8 = 5
+
+	// DefaultMaxFrameSize - the maximum size of a frame a peer accepts unless configured otherwise.
+	DefaultMaxFrameSize uint32 = 1 << 16
+)
+
+// Magic bytes opening the HELLO and WELCOME messages. Read as the int16 SYN of the legacy handshake
+// the first two bytes of helloMagic are far out of the range of the legacy client.
+//
+//nolint:gochecknoglobals // immutable values
+var (
+	helloMagic   = []byte("WOWH")
+	welcomeMagic = []byte("WOWW")
+)
+
+// Tags of the fields of HELLO and WELCOME messages. Unknown fields are skipped, so new ones may be added
+// without breaking older peers.
+const (
+	// fieldVersions - versions supported by the client, one byte each
+	fieldVersions uint8 = iota + 1
+	// fieldVersion - version selected by the server, one byte
+	fieldVersion
+	// fieldAlgorithms - comma separated PoW algorithms supported by the client
+	fieldAlgorithms
+	// fieldAlgorithm - PoW algorithm of the server
+	fieldAlgorithm
+	// fieldComplexity - PoW difficulty target bits, one byte. Zero means PoW is disabled
+	fieldComplexity
+	// fieldCompression - comma separated compression algorithms supported by the client or selected by the server
+	fieldCompression
+	// fieldMaxFrameSize - the maximum size of a frame, uint32
+	fieldMaxFrameSize
+	// fieldReadTimeout - the time the server waits for a response to the challenge in milliseconds, uint32
+	fieldReadTimeout
+	// fieldError - the reason the server rejected the HELLO message
+	fieldError
+	// fieldServerError - the error the server rejected the HELLO message with, encoded as the payload
+	// of an ERROR frame. Sent along with fieldError, which older clients understand
+	fieldServerError
+	// fieldClientID - optional ID of the client, telling apart the reputation of clients sharing an address
+	fieldClientID
+	// fieldMaxConcurrent - the maximum number of requests of the connection in flight at once, uint16.
+	// Sent since MultiplexVersion
+	fieldMaxConcurrent
+)
+
+// Tags of the fields of the payload of a challenge frame since ChallengeParamsVersion.
+const (
+	// challengeToken - the signed token
+	challengeToken uint8 = iota + 1
+	// challengeAlgorithm - name of the hash function
+	challengeAlgorithm
+	// challengeTargetBits - difficulty of the challenge rounded up to whole bits, one byte
+	challengeTargetBits
+	// challengeTarget - target of the challenge encoded as the largest acceptable hash, 32 bytes
+	challengeTarget
+)
+
+// Session represents the parameters of the connection negotiated by the handshake.
+type Session struct {
+	// Version - the negotiated version of the protocol
+	Version uint8
+	// Complexity - PoW difficulty target bits at the time of the handshake. Zero means PoW is disabled
+	Complexity uint8
+	// Algorithm - name of the PoW algorithm, empty if PoW is disabled
+	Algorithm string
+	// Compression - compression algorithms supported by both peers
+	Compression []string
+	// MaxFrameSize - the maximum size of a frame accepted by both peers
+	MaxFrameSize uint32
+	// ReadTimeout - the time the server waits for a response to the challenge. Zero means no timeout
+	ReadTimeout time.Duration
+	// MaxConcurrent - the maximum number of requests in flight at once, 1 before MultiplexVersion
+	MaxConcurrent uint16
+}
+
+// hello represents the capabilities advertised by the client.
+type hello struct {
+	versions     []uint8
+	algorithms   []string
+	compression  []string
+	maxFrameSize uint32
+	clientID     string
+}
+
+// fields of a HELLO or WELCOME message, by tag.
+type fields map[uint8][]byte
+
+// writeMessage writes the message: magic bytes, uint16 length of the fields and the fields encoded as
+// tag uint8, uint16 length and value.
+func writeMessage(w io.Writer, magic []byte, f fields) error {
+	body, err := f.marshal()
+	if err != nil {
+		return fmt.Errorf("writeMessage - marshal: %v", err)
+	}
+	if len(body) > math.MaxUint16 {
+		return fmt.Errorf("writeMessage: message is too long")
+	}
+
+	msg := make([]byte, 0, len(magic)+2+len(body))
+	msg = append(msg, magic...)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(body)))
+	msg = append(msg, body...)
+	_, err = w.Write(msg)
+	return err
+}
+
+// marshal encodes the fields as tag uint8, uint16 length and value.
+func (f fields) marshal() ([]byte, error) {
+	body := new(bytes.Buffer)
+	for tag, value := range f {
+		if len(value) > math.MaxUint16 {
+			return nil, fmt.Errorf("marshal: field %d is too long", tag)
+		}
+		body.WriteByte(tag)
+		_ = binary.Write(body, binary.BigEndian, uint16(len(value)))
+		body.Write(value)
+	}
+	return body.Bytes(), nil
+}
+
+// readFields reads the length and the fields of a message following its magic bytes.
+func readFields(r io.Reader) (fields, error) {
+	var size uint16
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, fmt.Errorf("readFields - Read: %w", err)
+	}
+	body := make([]byte, size)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, fmt.Errorf("readFields - ReadFull: %w", err)
+	}
+	return parseFields(body)
+}
+
+// parseFields decodes the fields encoded as tag uint8, uint16 length and value.
+func parseFields(body []byte) (fields, error) {
+	f := make(fields)
+	for len(body) > 0 {
+		if len(body) < 3 {
+			return nil, fmt.Errorf("parseFields: truncated field")
+		}
+		tag, n := body[0], int(binary.BigEndian.Uint16(body[1:3]))
+		if len(body) < 3+n {
+			return nil, fmt.Errorf("parseFields: truncated field %d", tag)
+		}
+		f[tag] = body[3 : 3+n]
+		body = body[3+n:]
+	}
+	return f, nil
+}
+
+// readMagic reads the magic bytes of a message and checks them.
+func readMagic(r io.Reader, magic []byte) error {
+	got := make([]byte, len(magic))
+	_, err := io.ReadFull(r, got)
+	if err != nil {
+		return fmt.Errorf("readMagic - ReadFull: %w", err)
+	}
+	if !bytes.Equal(got, magic) {
+		return fmt.Errorf("readMagic: unexpected message %q", got)
+	}
+	return nil
+}
+
+// marshal returns the fields of the HELLO message.
+func (h *hello) marshal() fields {
+	f := fields{
+		fieldVersions:     h.versions,
+		fieldAlgorithms:   []byte(strings.Join(h.algorithms, ",")),
+		fieldCompression:  []byte(strings.Join(h.compression, ",")),
+		fieldMaxFrameSize: binary.BigEndian.AppendUint32(nil, h.maxFrameSize),
+	}
+	if h.clientID != "" {
+		f[fieldClientID] = []byte(h.clientID)
+	}
+	return f
+}
+
+// parseHello parses the fields of the HELLO message.
+func parseHello(f fields) (*hello, error) {
+	h := &hello{
+		versions:     f[fieldVersions],
+		algorithms:   splitList(f[fieldAlgorithms]),
+		compression:  splitList(f[fieldCompression]),
+		maxFrameSize: DefaultMaxFrameSize,
+		clientID:     string(f[fieldClientID]),
+	}
+	if len(h.versions) == 0 {
+		return nil, fmt.Errorf("parseHello: no versions")
+	}
+	if len(h.clientID) > maxClientIDLen {
+		return nil, fmt.Errorf("parseHello: client ID is longer than %d bytes", maxClientIDLen)
+	}
+	if v, ok := f[fieldMaxFrameSize]; ok {
+		if len(v) != 4 {
+			return nil, fmt.Errorf("parseHello: invalid max frame size")
+		}
+		h.maxFrameSize = binary.BigEndian.Uint32(v)
+	}
+	return h, nil
+}
+
+// marshalWelcome returns the fields of the WELCOME message.
+func marshalWelcome(s *Session) fields {
+	f := fields{
+		fieldVersion:      {s.Version},
+		fieldComplexity:   {s.Complexity},
+		fieldAlgorithm:    []byte(s.Algorithm),
+		fieldCompression:  []byte(strings.Join(s.Compression, ",")),
+		fieldMaxFrameSize: binary.BigEndian.AppendUint32(nil, s.MaxFrameSize),
+		fieldReadTimeout:  binary.BigEndian.AppendUint32(nil, uint32(s.ReadTimeout.Milliseconds())),
+	}
+	if s.Version >= MultiplexVersion {
+		f[fieldMaxConcurrent] = binary.BigEndian.AppendUint16(nil, s.MaxConcurrent)
+	}
+	return f
+}
+
+// parseWelcome parses the fields of the WELCOME message.
+func parseWelcome(f fields) (*Session, error) {
+	if payload, ok := f[fieldServerError]; ok {
+		serverErr, err := parseServerError(payload)
+		if err != nil {
+			return nil, fmt.Errorf("parseWelcome - parseServerError: %v", err)
+		}
+		return nil, fmt.Errorf("parseWelcome: rejected by the server: %w", serverErr)
+	}
+	if reason, ok := f[fieldError]; ok {
+		return nil, fmt.Errorf("parseWelcome: rejected by the server: %s", reason)
+	}
+	if len(f[fieldVersion]) != 1 || len(f[fieldComplexity]) != 1 ||
+		len(f[fieldMaxFrameSize]) != 4 || len(f[fieldReadTimeout]) != 4 {
+		return nil, fmt.Errorf("parseWelcome: invalid message")
+	}
+	session := &Session{
+		Version:       f[fieldVersion][0],
+		Complexity:    f[fieldComplexity][0],
+		Algorithm:     string(f[fieldAlgorithm]),
+		Compression:   splitList(f[fieldCompression]),
+		MaxFrameSize:  binary.BigEndian.Uint32(f[fieldMaxFrameSize]),
+		ReadTimeout:   time.Duration(binary.BigEndian.Uint32(f[fieldReadTimeout])) * time.Millisecond,
+		MaxConcurrent: 1,
+	}
+	if session.Version >= MultiplexVersion {
+		if len(f[fieldMaxConcurrent]) != 2 || binary.BigEndian.Uint16(f[fieldMaxConcurrent]) == 0 {
+			return nil, fmt.Errorf("parseWelcome: invalid max concurrent requests")
+		}
+		session.MaxConcurrent = binary.BigEndian.Uint16(f[fieldMaxConcurrent])
+	}
+	return session, nil
+}
+
+// rejection returns the fields of the WELCOME message rejecting the client with the error.
+func rejection(serverErr *ServerError) fields {
+	return fields{
+		fieldError:       []byte(serverErr.Message),
+		fieldServerError: serverErr.marshal(),
+	}
+}
+
+// splitList splits a comma separated list.
+func splitList(b []byte) []string {
+	if len(b) == 0 {
+		return nil
+	}
+	return strings.Split(string(b), ",")
+}
+
+// contains reports whether the list contains the value.
+func contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiate selects the highest version supported by both peers and the capabilities of the session,
+// challenging the requests if pow is set.
+func (s *Server) negotiate(h *hello, pow bool) (*Session, error) {
+	session := &Session{MaxFrameSize: DefaultMaxFrameSize, MaxConcurrent: 1}
+	for _, v := range h.versions {
+		if v > LegacyVersion && v <= ProtocolVersion && v > session.Version {
+			session.Version = v
+		}
+	}
+	if session.Version == LegacyVersion {
+		return nil, fmt.Errorf("no common protocol version, the client supports %v", h.versions)
+	}
+	if session.Version >= MultiplexVersion {
+		session.MaxConcurrent = s.maxConcurrent
+	}
+
+	if pow {
+		session.Complexity = uint8(s.crProto.GetComplexity())
+		session.Algorithm = s.crProto.Algorithm().Name()
+		session.ReadTimeout = s.crProto.ReadTimeout()
+		if !contains(h.algorithms, session.Algorithm) {
+			return nil, fmt.Errorf("PoW algorithm %s is not supported by the client", session.Algorithm)
+		}
+	}
+
+	for _, name := range h.compression {
+		if contains(supportedCompression(), name) {
+			session.Compression = append(session.Compression, name)
+		}
+	}
+	if h.maxFrameSize < session.MaxFrameSize {
+		session.MaxFrameSize = h.maxFrameSize
+	}
+	return session, nil
+}
+
+// supportedCompression returns the compression algorithms supported by the package.
+func supportedCompression() []string {
+	return []string{compressionFlate}
+}
+
+// helloVersions returns the versions advertised by the client, all since the one introducing HELLO.
+func helloVersions() []uint8 {
+	versions := make([]uint8, 0, ProtocolVersion)
+	for v := LegacyVersion + 1; v <= ProtocolVersion; v++ {
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// handshake reads the first message of the client and performs the HELLO/WELCOME handshake,
+// or the legacy SYN/ACK one for clients of version 0.
+func (c *conn) handshake() error {
+	err := c.rwc.SetReadDeadline(time.Now().Add(c.server.synTimeout))
+	if err != nil {
+		return fmt.Errorf("handshake - SetReadDeadline: %w", err)
+	}
+
+	head := make([]byte, 2)
+	_, err = io.ReadFull(c.br, head)
+	if err != nil {
+		return fmt.Errorf("handshake - ReadFull: %w", err)
+	}
+
+	if !bytes.Equal(head, helloMagic[:2]) {
+		err = c.legacyHandshake(int16(binary.LittleEndian.Uint16(head)))
+		if err != nil {
+			return fmt.Errorf("handshake - legacyHandshake: %w", err)
+		}
+		return nil
+	}
+
+	err = readMagic(c.br, helloMagic[2:])
+	if err != nil {
+		return fmt.Errorf("handshake - readMagic: %w", err)
+	}
+	f, err := readFields(c.br)
+	if err != nil {
+		return fmt.Errorf("handshake - readFields: %w", err)
+	}
+	h, err := parseHello(f)
+	if err != nil {
+		return fmt.Errorf("handshake - parseHello: %v", err)
+	}
+
+	session, err := c.server.negotiate(h, c.powEnabled())
+	if err != nil {
+		_ = writeMessage(c.rwc, welcomeMagic, rejection(&ServerError{Code: CodeBadRequest, Message: err.Error()}))
+		return fmt.Errorf("handshake - negotiate: %v", err)
+	}
+	c.clientID = h.clientID
+	if session.Algorithm != "" {
+		session.Complexity = c.complexity()
+	}
+	err = writeMessage(c.rwc, welcomeMagic, marshalWelcome(session))
+	if err != nil {
+		return fmt.Errorf("handshake - writeMessage: %w", err)
+	}
+	c.session = session
+	return nil
+}
+
+// reject tells the client it is rejected with the error in place of the WELCOME message. The client is
+// given errorWriteTimeout to send its HELLO, clients of version 0 cannot be told and are just closed.
+func (c *conn) reject(serverErr *ServerError) {
+	_ = c.rwc.SetDeadline(time.Now().Add(errorWriteTimeout))
+
+	head := make([]byte, len(helloMagic))
+	_, err := io.ReadFull(c.br, head)
+	if err != nil || !bytes.Equal(head, helloMagic) {
+		return
+	}
+	// The HELLO message is read to the end, so closing the connection does not reset it
+	// before the client reads the rejection
+	_, err = readFields(c.br)
+	if err != nil {
+		return
+	}
+	_ = writeMessage(c.rwc, welcomeMagic, rejection(serverErr))
+}
+
+// legacyHandshake answers the SYN value of a client of version 0.
+func (c *conn) legacyHandshake(syn int16) error {
+	// Retrieve the complexity level from the challenge-response protocol, if implemented
+	var crComplexity int16
+	if c.powEnabled() {
+		// Nothing but ACK can be sent to the clients of version 0, which always hash with SHA-256
+		if name := c.server.crProto.Algorithm().Name(); name != SHA256 {
+			return fmt.Errorf("legacyHandshake: version 0 clients support %s only, the server uses %s", SHA256, name)
+		}
+		crComplexity = int16(c.complexity())
+	}
+	err := c.ack(syn, crComplexity)
+	if err != nil {
+		return fmt.Errorf("legacyHandshake - ack: %w", err)
+	}
+
+	c.session = &Session{Version: LegacyVersion, Complexity: uint8(crComplexity), MaxFrameSize: DefaultMaxFrameSize, MaxConcurrent: 1}
+	if crComplexity != 0 {
+		c.session.Algorithm = SHA256
+		c.session.ReadTimeout = c.server.crProto.ReadTimeout()
+	}
+	return nil
+}
+
+// hello performs the HELLO/WELCOME handshake and initializes the challenge-response protocol
+// the server announced.
+func (c *Client) hello() error {
+	h := &hello{
+		versions:     helloVersions(),
+		algorithms:   Algorithms(),
+		compression:  supportedCompression(),
+		maxFrameSize: DefaultMaxFrameSize,
+		clientID:     c.clientID,
+	}
+	err := writeMessage(c.conn, helloMagic, h.marshal())
+	if err != nil {
+		return fmt.Errorf("hello - writeMessage: %v", err)
+	}
+
+	err = readMagic(c.conn, welcomeMagic)
+	if err != nil {
+		return fmt.Errorf("hello - readMagic: %v", err)
+	}
+	f, err := readFields(c.conn)
+	if err != nil {
+		return fmt.Errorf("hello - readFields: %v", err)
+	}
+	session, err := parseWelcome(f)
+	if err != nil {
+		return fmt.Errorf("hello - parseWelcome: %w", err)
+	}
+	if session.Version == LegacyVersion || session.Version > ProtocolVersion {
+		return fmt.Errorf("hello: unsupported protocol version %d", session.Version)
+	}
+
+	// The algorithm is announced whenever PoW is enabled, even if its complexity is zero at the moment
+	if session.Algorithm != "" {
+		alg, err := LookupAlgorithm(session.Algorithm)
+		if err != nil {
+			return fmt.Errorf("hello - LookupAlgorithm: %v", err)
+		}
+		c.crProto = NewProofOfWork(session.Complexity, 0, WithAlgorithm(alg))
+	}
+	c.session = *session
+	return nil
+}
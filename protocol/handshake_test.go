@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Negotiate(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	server := NewServer(logger.Sugar(), NewProofOfWork(12, time.Second*10), time.Second*60, nil)
+
+	// The highest common version is selected
+	session, err := server.negotiate(&hello{
+		versions:     []uint8{LegacyVersion, ProtocolVersion, ProtocolVersion + 1},
+		algorithms:   []string{Scrypt, SHA256},
+		compression:  []string{"unknown"},
+		maxFrameSize: 1024,
+	}, true)
+	require.NoError(t, err)
+	require.Equal(t, &Session{
+		Version:       ProtocolVersion,
+		Complexity:    12,
+		Algorithm:     SHA256,
+		MaxFrameSize:  1024,
+		ReadTimeout:   time.Second * 10,
+		MaxConcurrent: defaultMaxConcurrent,
+	}, session)
+
+	_, err = server.negotiate(&hello{versions: []uint8{ProtocolVersion + 1}, algorithms: []string{SHA256}}, true)
+	require.Error(t, err)
+
+	_, err = server.negotiate(&hello{versions: []uint8{ProtocolVersion}, algorithms: []string{Scrypt}}, true)
+	require.Error(t, err)
+}
+
+func TestClient_Hello(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Test quote"
+
+	server := NewServer(logger.Sugar(), NewProofOfWork(4, time.Second*10, WithAlgorithm(scryptAlgorithm{})), time.Second*60,
+		func(ctx context.Context, request *Request) (*Response, error) {
+			response := Response(testQuote)
+			return &response, nil
+		})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	require.Equal(t, ProtocolVersion, c.Session().Version)
+	require.Equal(t, uint8(4), c.Session().Complexity)
+	require.Equal(t, Scrypt, c.Session().Algorithm)
+
+	quote, err := c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, testQuote, quote)
+
+	// Version 0 clients cannot be told the algorithm and hash with SHA-256, so they are refused
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = NewClient(conn, WithLegacyHandshake())
+	require.Error(t, err)
+}
+
+func TestClient_HelloRejected(t *testing.T) {
+	server, client := net.Pipe()
+	go func() {
+		_ = readMagic(server, helloMagic)
+		_, _ = readFields(server)
+		_ = writeMessage(server, welcomeMagic, fields{fieldError: []byte("no common protocol version")})
+	}()
+
+	_, err := NewClient(client)
+	require.ErrorContains(t, err, "no common protocol version")
+}
+
+// TestServer_LegacyClient replays the wire format of the clients released before HELLO, which read nothing
+// after ACK, hash the challenge with SHA-256 and respond without the token.
+func TestServer_LegacyClient(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Test quote"
+
+	server := NewServer(logger.Sugar(), NewProofOfWork(8, time.Second*10), time.Second*60,
+		func(ctx context.Context, request *Request) (*Response, error) {
+			response := Response(testQuote)
+			return &response, nil
+		})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second*10)))
+
+	syn := int16(42)
+	require.NoError(t, binary.Write(conn, binary.LittleEndian, syn))
+	var ack int32
+	require.NoError(t, binary.Read(conn, binary.LittleEndian, &ack))
+	require.Equal(t, int32(syn)+8, ack)
+
+	reader := bufio.NewReader(conn)
+	for i := 0; i < 2; i++ {
+		_, err = conn.Write([]byte("GetQuote\n"))
+		require.NoError(t, err)
+
+		data, err := reader.ReadBytes('|')
+		require.NoError(t, err)
+		data = data[:len(data)-1]
+		trailer := make([]byte, 3)
+		_, err = io.ReadFull(reader, trailer)
+		require.NoError(t, err)
+		require.Equal(t, "EOM", string(trailer))
+
+		target := new(big.Int).Lsh(big.NewInt(1), uint(256-(ack-int32(syn))))
+		for nonce := uint32(0); ; nonce++ {
+			hexNonce := []byte(fmt.Sprintf("%x", nonce))
+			hash := sha256.Sum256(append(hexNonce, data...))
+			if new(big.Int).SetBytes(hash[:]).Cmp(target) == -1 {
+				_, err = conn.Write(bytes.Join([][]byte{hash[:], hexNonce, []byte("EOM")}, []byte{'|'}))
+				require.NoError(t, err)
+				break
+			}
+		}
+
+		quote, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, testQuote+"\n", quote)
+	}
+}
@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultIPv4Prefix - IPv4 addresses are limited one by one unless configured otherwise
+	defaultIPv4Prefix = 32
+	// defaultIPv6Prefix - IPv6 addresses are limited by /64 subnets unless configured otherwise,
+	// as a single host usually gets the whole subnet
+	defaultIPv6Prefix = 64
+	// defaultRetryAfter - the time rejected clients are advised to wait unless configured otherwise
+	defaultRetryAfter = time.Second
+	// maxRejecting - the maximum number of rejected connections being told they are rejected,
+	// the connections over it are closed right away
+	maxRejecting = 1024
+)
+
+// LimiterConfig represents the configuration of the connection limiter. A zero limit disables it.
+type LimiterConfig struct {
+	// MaxConns - the maximum number of connections served at once
+	MaxConns int
+	// MaxConnsPerIP - the maximum number of connections served at once per source subnet
+	MaxConnsPerIP int
+	// MaxChallengesPerIP - the maximum number of unsolved challenges per source subnet
+	MaxChallengesPerIP int
+	// IPv4Prefix - length of the prefix of the IPv4 subnets limited as a single source, 32 if zero
+	IPv4Prefix int
+	// IPv6Prefix - length of the prefix of the IPv6 subnets limited as a single source, 64 if zero
+	IPv6Prefix int
+	// RetryAfter - the time rejected clients are advised to wait before reconnecting, a second if zero
+	RetryAfter time.Duration
+}
+
+// Limiter caps the connections of the server and the unsolved challenges of their sources.
+// Connections over the limits are rejected with ErrServerBusy.
+type Limiter struct {
+	// Limiter configuration
+	cfg LimiterConfig
+
+	// mu guards the counters
+	mu sync.Mutex
+	// conns - number of connections being served
+	conns int
+	// rejecting - number of rejected connections being told they are rejected
+	rejecting int
+	// sourceConns - number of connections being served by source subnet
+	sourceConns map[string]int
+	// sourceChallenges - number of unsolved challenges by source subnet
+	sourceChallenges map[string]int
+}
+
+// NewLimiter creates a new connection limiter.
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = defaultIPv4Prefix
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = defaultIPv6Prefix
+	}
+	if cfg.RetryAfter == 0 {
+		cfg.RetryAfter = defaultRetryAfter
+	}
+	return &Limiter{cfg: cfg, sourceConns: make(map[string]int), sourceChallenges: make(map[string]int)}
+}
+
+// WithLimiter enables the connection limiter.
+func WithLimiter(limiter *Limiter) ServerOption {
+	return func(s *Server) {
+		s.limiter = limiter
+	}
+}
+
+// source returns the subnet the address belongs to.
+func (l *Limiter) source(addr net.Addr) string {
+	return subnet(addr, l.cfg.IPv4Prefix, l.cfg.IPv6Prefix)
+}
+
+// subnet returns the subnet of the prefix length the address belongs to. Addresses other than IP ones
+// are returned as they are, so they are told apart one by one.
+func subnet(addr net.Addr, ipv4Prefix, ipv6Prefix int) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(ipv4Prefix, 8*net.IPv4len)).String()
+	}
+	return ip.Mask(net.CIDRMask(ipv6Prefix, 8*net.IPv6len)).String()
+}
+
+// acquireConn counts a new connection of the source, or returns ErrServerBusy if it is over a limit.
+func (l *Limiter) acquireConn(source string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxConns > 0 && l.conns >= l.cfg.MaxConns {
+		return l.busy("too many connections")
+	}
+	if l.cfg.MaxConnsPerIP > 0 && l.sourceConns[source] >= l.cfg.MaxConnsPerIP {
+		return l.busy("too many connections from %s", source)
+	}
+	l.conns++
+	l.sourceConns[source]++
+	return nil
+}
+
+// releaseConn forgets a finished connection of the source.
+func (l *Limiter) releaseConn(source string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns--
+	release(l.sourceConns, source)
+}
+
+// acquireChallenge counts a new unsolved challenge of the source, or returns ErrServerBusy if it is over the limit.
+func (l *Limiter) acquireChallenge(source string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg.MaxChallengesPerIP > 0 && l.sourceChallenges[source] >= l.cfg.MaxChallengesPerIP {
+		return l.busy("too many unsolved challenges from %s", source)
+	}
+	l.sourceChallenges[source]++
+	return nil
+}
+
+// releaseChallenge forgets a solved or failed challenge of the source.
+func (l *Limiter) releaseChallenge(source string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	release(l.sourceChallenges, source)
+}
+
+// acquireRejecting counts a rejected connection to be told it is rejected. It returns false if there are
+// too many of them already, so a flood of connections holds a bounded number of goroutines.
+func (l *Limiter) acquireRejecting() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rejecting >= maxRejecting {
+		return false
+	}
+	l.rejecting++
+	return true
+}
+
+// releaseRejecting forgets a rejected connection.
+func (l *Limiter) releaseRejecting() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rejecting--
+}
+
+// busy returns ErrServerBusy advising to retry after the configured time.
+func (l *Limiter) busy(format string, args ...interface{}) *ServerError {
+	return &ServerError{Code: CodeServerBusy, RetryAfter: l.cfg.RetryAfter, Message: fmt.Sprintf(format, args...)}
+}
+
+// release decrements the counter of the key, deleting it once it is zero to keep the map small.
+func release(counters map[string]int, key string) {
+	if counters[key] <= 1 {
+		delete(counters, key)
+		return
+	}
+	counters[key]--
+}
@@ -0,0 +1,88 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_Source(t *testing.T) {
+	limiter := NewLimiter(LimiterConfig{IPv4Prefix: 24})
+	for addr, source := range map[string]string{
+		"192.168.1.17:4000":        "192.168.1.0",
+		"[2001:db8:1:2:3::4]:4000": "2001:db8:1:2::",
+		"[::ffff:10.0.0.9]:4000":   "10.0.0.0",
+	} {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		require.NoError(t, err)
+		require.Equal(t, source, limiter.source(tcpAddr), addr)
+	}
+
+	require.NoError(t, limiter.acquireConn("a"))
+	limiter.releaseConn("a")
+	require.Empty(t, limiter.sourceConns)
+}
+
+func TestServer_Limiter(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	handler := func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	}
+
+	// Connections over the limit are rejected in place of the WELCOME message
+	server := NewServer(logger.Sugar(), nil, time.Second*60, handler,
+		WithLimiter(NewLimiter(LimiterConfig{MaxConnsPerIP: 1, RetryAfter: 3 * time.Second})))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	first, err := NewClient(conn)
+	require.NoError(t, err)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = NewClient(conn)
+	require.ErrorIs(t, err, ErrServerBusy)
+	var serverErr *ServerError
+	require.ErrorAs(t, err, &serverErr)
+	require.Equal(t, 3*time.Second, serverErr.RetryAfter)
+
+	// The connection is counted until it is closed
+	require.NoError(t, first.conn.Close())
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = NewClient(conn)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	// Requests over the limit of unsolved challenges get a busy frame
+	server = NewServer(logger.Sugar(), NewProofOfWork(8, time.Second*10), time.Second*60, handler,
+		WithLimiter(NewLimiter(LimiterConfig{MaxChallengesPerIP: 1})))
+	l, err = net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	first, err = NewClient(conn)
+	require.NoError(t, err)
+	require.NoError(t, first.enc.Encode(&Frame{Type: FrameRequest, Payload: []byte(CmdGetQuote)}))
+	f, err := first.dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, FrameChallenge, f.Type)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	second, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = second.GetQuote()
+	require.ErrorIs(t, err, ErrServerBusy)
+}
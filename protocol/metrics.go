@@ -0,0 +1,58 @@
+package protocol
+
+import "time"
+
+// Metrics records the behaviour of the server and of the Proof of Work, for instance to export it to Prometheus.
+// The methods are called concurrently by the goroutines serving the connections and must not block.
+type Metrics interface {
+	// ConnAccepted is called when a connection within the limits of the server is accepted
+	ConnAccepted()
+	// ConnClosed is called once an accepted connection is served
+	ConnClosed()
+	// Handshake is called when the handshake of a connection completes with the negotiated version, or fails
+	Handshake(version uint8, err error)
+	// ChallengeIssued is called when a challenge of the difficulty in bits is issued to a client
+	ChallengeIssued(difficulty float64)
+	// ChallengeSolved is called when the solution of a challenge is accepted
+	ChallengeSolved()
+	// ChallengeFailed is called when the solution of a challenge is rejected or the client fails otherwise
+	ChallengeFailed()
+	// ChallengeTimedOut is called when no solution of a challenge is received within the read timeout
+	ChallengeTimedOut()
+	// Verified is called with the time the verification of a solution took and its error
+	Verified(latency time.Duration, err error)
+	// DifficultyChanged is called with the difficulty in bits of the Proof of Work whenever it is set
+	DifficultyChanged(bits float64)
+	// Request is called with the command of a request, the time the handler took and its error by the Latency
+	// middleware wrapping the handler, and by the server when it refuses a request of an unknown command
+	Request(command string, latency time.Duration, err error)
+}
+
+// WithMetrics makes the server record its metrics. The requests are recorded by the handler wrapped with
+// the Latency middleware, e.g. WithMiddleware(Latency(metrics.Request)).
+func WithMetrics(metrics Metrics) ServerOption {
+	return func(s *Server) {
+		s.metrics = metrics
+	}
+}
+
+// WithPowMetrics makes the Proof of Work record the verification of the solutions and its difficulty.
+func WithPowMetrics(metrics Metrics) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.metrics = metrics
+	}
+}
+
+// nopMetrics records nothing, it is used unless metrics are configured.
+type nopMetrics struct{}
+
+func (nopMetrics) ConnAccepted()                        {}
+func (nopMetrics) ConnClosed()                          {}
+func (nopMetrics) Handshake(uint8, error)               {}
+func (nopMetrics) ChallengeIssued(float64)              {}
+func (nopMetrics) ChallengeSolved()                     {}
+func (nopMetrics) ChallengeFailed()                     {}
+func (nopMetrics) ChallengeTimedOut()                   {}
+func (nopMetrics) Verified(time.Duration, error)        {}
+func (nopMetrics) DifficultyChanged(float64)            {}
+func (nopMetrics) Request(string, time.Duration, error) {}
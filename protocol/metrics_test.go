@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testMetrics counts the recorded events by name.
+type testMetrics struct {
+	mu         sync.Mutex
+	events     map[string]int
+	difficulty float64
+}
+
+func (m *testMetrics) record(event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.events == nil {
+		m.events = make(map[string]int)
+	}
+	m.events[event]++
+}
+
+func (m *testMetrics) count(event string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.events[event]
+}
+
+func (m *testMetrics) ConnAccepted()           { m.record("accepted") }
+func (m *testMetrics) ConnClosed()             { m.record("closed") }
+func (m *testMetrics) ChallengeSolved()        { m.record("solved") }
+func (m *testMetrics) ChallengeFailed()        { m.record("failed") }
+func (m *testMetrics) ChallengeTimedOut()      { m.record("timed out") }
+func (m *testMetrics) ChallengeIssued(float64) { m.record("issued") }
+
+func (m *testMetrics) Handshake(version uint8, err error) {
+	if err != nil {
+		m.record("handshake error")
+		return
+	}
+	m.record("handshake")
+}
+
+func (m *testMetrics) Verified(latency time.Duration, err error) {
+	if err != nil {
+		m.record("verify error")
+		return
+	}
+	m.record("verified")
+}
+
+func (m *testMetrics) DifficultyChanged(bits float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.difficulty = bits
+}
+
+func (m *testMetrics) Request(command string, latency time.Duration, err error) {
+	if err != nil {
+		m.record(command + " error")
+		return
+	}
+	m.record(command)
+}
+
+func TestServer_Metrics(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	metrics := &testMetrics{}
+	pow := NewProofOfWork(4, time.Millisecond*200, WithPowMetrics(metrics))
+	require.Equal(t, float64(4), metrics.difficulty)
+	pow.SetDifficulty(6)
+	require.Equal(t, float64(6), metrics.difficulty)
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		if request.Command() == "GetQuoteByID" {
+			return nil, ErrNotFound
+		}
+		response := Response("Test quote")
+		return &response, nil
+	}, WithMetrics(metrics), WithMiddleware(Latency(metrics.Request)))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+	_, err = c.Do(context.Background(), "GetQuoteByID", "1")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.Equal(t, 1, metrics.count("accepted"))
+	require.Equal(t, 1, metrics.count("handshake"))
+	require.Equal(t, 2, metrics.count("issued"))
+	require.Equal(t, 2, metrics.count("solved"))
+	require.Equal(t, 2, metrics.count("verified"))
+	require.Equal(t, 1, metrics.count(CmdGetQuote))
+	require.Equal(t, 1, metrics.count("GetQuoteByID error"))
+
+	// A challenge left unsolved times out
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err = NewClient(conn)
+	require.NoError(t, err)
+	require.NoError(t, c.enc.Encode(&Frame{Type: FrameRequest, ID: 1, Payload: []byte(CmdGetQuote)}))
+	f, err := c.dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, FrameChallenge, f.Type)
+	require.Eventually(t, func() bool { return metrics.count("timed out") == 1 }, time.Second*5, time.Millisecond*10)
+	require.Equal(t, 0, metrics.count("failed"))
+
+	require.NoError(t, conn.Close())
+	require.Eventually(t, func() bool { return metrics.count("closed") == 1 }, time.Second*5, time.Millisecond*10)
+	require.Equal(t, 2, metrics.count("accepted"))
+}
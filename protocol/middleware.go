@@ -0,0 +1,109 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Middleware wraps a handler with cross-cutting behaviour.
+type Middleware func(Handler) Handler
+
+// Chain wraps the handler with the middlewares. The first middleware is the outermost one,
+// so it sees the request first and the response last.
+func Chain(handler Handler, middlewares ...Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// WithMiddleware wraps the handler of the server with the middlewares, the first one being the outermost.
+// Middlewares of several options are chained in the order of the options.
+func WithMiddleware(middlewares ...Middleware) ServerOption {
+	return func(s *Server) {
+		s.middlewares = append(s.middlewares, middlewares...)
+	}
+}
+
+// connIDKey - context key of the ID of the connection.
+type connIDKey struct{}
+
+// ConnIDFromContext returns the ID of the connection the request was received on.
+// IDs are unique within the server.
+func ConnIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+// Logging logs every request with the ID and the address of its connection, its duration and its error.
+func Logging(logger *zap.SugaredLogger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Response, error) {
+			start := time.Now()
+			res, err := next(ctx, req)
+
+			id, _ := ConnIDFromContext(ctx)
+			fields := []interface{}{"conn", id, "command", req.Command(), "duration", time.Since(start)}
+			if err != nil {
+				logger.Errorw("request failed", append(fields, "error", err)...)
+			} else {
+				logger.Debugw("request served", fields...)
+			}
+			return res, err
+		}
+	}
+}
+
+// LatencyFunc is called with the command of the request, the time it took to handle it and its error.
+type LatencyFunc func(command string, latency time.Duration, err error)
+
+// Latency measures the time every request takes to be handled and reports it to observe,
+// e.g. Latency(metrics.Request) records it in the metrics of the server.
+func Latency(observe LatencyFunc) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Response, error) {
+			start := time.Now()
+			res, err := next(ctx, req)
+			observe(req.Command(), time.Since(start), err)
+			return res, err
+		}
+	}
+}
+
+// Recovery recovers the panics of the handler, logs them with the stack and returns ErrInternal instead.
+func Recovery(logger *zap.SugaredLogger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (res *Response, err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					id, _ := ConnIDFromContext(ctx)
+					logger.Errorw("handler panicked", "conn", id, "command", req.Command(), "panic", p, "stack", string(debug.Stack()))
+					res, err = nil, fmt.Errorf("Recovery: %w: panic: %v", ErrInternal, p)
+				}
+			}()
+			return next(ctx, req)
+		}
+	}
+}
+
+// Timeout limits the time every request may take to be handled. The context of the request is canceled
+// at the deadline, and the client gets ErrRequestTimeout if the handler fails because of it.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Response, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			res, err := next(ctx, req)
+			if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, &ServerError{Code: CodeRequestTimeout, Message: fmt.Sprintf("request timed out after %v", timeout)}
+			}
+			return res, err
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestChain(t *testing.T) {
+	var calls []string
+	mark := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, req *Request) (*Response, error) {
+				calls = append(calls, name)
+				return next(ctx, req)
+			}
+		}
+	}
+	handler := Chain(func(ctx context.Context, req *Request) (*Response, error) {
+		calls = append(calls, "handler")
+		return nil, nil
+	}, mark("first"), mark("second"))
+
+	req := Request(CmdGetQuote)
+	_, err := handler(context.Background(), &req)
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "second", "handler"}, calls)
+}
+
+func TestMiddlewares(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	logger := zap.New(core).Sugar()
+	req := Request(CmdGetQuote)
+
+	panicking := Recovery(logger)(func(ctx context.Context, req *Request) (*Response, error) {
+		panic("boom")
+	})
+	_, err := panicking(context.Background(), &req)
+	require.ErrorIs(t, err, ErrInternal)
+	require.Equal(t, 1, logs.FilterMessage("handler panicked").Len())
+
+	slow := Timeout(10 * time.Millisecond)(func(ctx context.Context, req *Request) (*Response, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	_, err = slow(context.Background(), &req)
+	require.ErrorIs(t, err, ErrRequestTimeout)
+
+	var latency time.Duration
+	failing := Logging(logger)(Latency(func(command string, d time.Duration, err error) {
+		require.Equal(t, CmdGetQuote, command)
+		require.Error(t, err)
+		latency = d
+	})(func(ctx context.Context, req *Request) (*Response, error) {
+		time.Sleep(time.Millisecond)
+		return nil, errors.New("failed")
+	}))
+	_, err = failing(context.WithValue(context.Background(), connIDKey{}, uint64(7)), &req)
+	require.Error(t, err)
+	require.GreaterOrEqual(t, latency, time.Millisecond)
+
+	entries := logs.FilterMessage("request failed").All()
+	require.Len(t, entries, 1)
+	require.Equal(t, uint64(7), entries[0].ContextMap()["conn"])
+	require.Equal(t, CmdGetQuote, entries[0].ContextMap()["command"])
+}
+
+func TestServer_ConnID(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	ids := make(chan uint64, 2)
+
+	server := NewServer(logger.Sugar(), nil, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	}, WithMiddleware(func(next Handler) Handler {
+		return func(ctx context.Context, req *Request) (*Response, error) {
+			id, ok := ConnIDFromContext(ctx)
+			require.True(t, ok)
+			ids <- id
+			return next(ctx, req)
+		}
+	}))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		c, err := NewClient(conn)
+		require.NoError(t, err)
+		_, err = c.GetQuote()
+		require.NoError(t, err)
+	}
+	require.NotEqual(t, <-ids, <-ids)
+}
@@ -0,0 +1,433 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMaxConcurrent - the maximum number of requests of a connection handled at once unless configured otherwise
+	defaultMaxConcurrent = 8
+	// streamFrames - the most frames the reader queues for a request: a solution on the server, an access token
+	// and the response on the client
+	streamFrames = 2
+)
+
+// WithMaxConcurrentRequests sets the maximum number of requests of a connection handled at once, announced
+// to the clients of MultiplexVersion and later. The requests over it are refused with ErrServerBusy.
+func WithMaxConcurrentRequests(n int) ServerOption {
+	return func(s *Server) {
+		switch {
+		case n < 1:
+			s.maxConcurrent = 1
+		case n > math.MaxUint16:
+			s.maxConcurrent = math.MaxUint16
+		default:
+			s.maxConcurrent = uint16(n)
+		}
+	}
+}
+
+// stream represents a request being served. Requests of the connections preceding MultiplexVersion are served
+// one at a time and read their frames from the connection, the ones of multiplexed connections are served
+// concurrently and get their frames from the reader of the connection.
+type stream struct {
+	// conn the request is received on
+	conn *conn
+	// id - ID of the request, carried by its frames
+	id uint32
+	// frames - frames of the request passed by the reader, nil if the connection is not multiplexed
+	frames chan *Frame
+}
+
+// multiplexed reports whether the request shares its connection with other ones.
+func (s *stream) multiplexed() bool {
+	return s.frames != nil
+}
+
+// send writes the frame of the request.
+func (s *stream) send(f *Frame) error {
+	f.ID = s.id
+	return s.conn.enc.Encode(f)
+}
+
+// recv reads the next frame of the request other than a ping. The read fails with a timeout error
+// once the deadline is reached, unless it is zero.
+func (s *stream) recv(ctx context.Context, deadline time.Time) (*Frame, error) {
+	if !s.multiplexed() {
+		if !deadline.IsZero() {
+			err := s.conn.rwc.SetReadDeadline(deadline)
+			if err != nil {
+				return nil, fmt.Errorf("recv - SetReadDeadline: %v", err)
+			}
+			defer func() { _ = s.conn.rwc.SetReadDeadline(time.Time{}) }()
+		}
+		return s.conn.readFrame()
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case f := <-s.frames:
+		return f, nil
+	case <-timeout:
+		return nil, fmt.Errorf("recv: %w", ErrChallengeTimeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fail answers the request of a multiplexed connection with the error frame describing err.
+// The connection stays open for the other requests.
+func (s *stream) fail(err error) {
+	_ = s.send(&Frame{Type: FrameError, Payload: NewServerError(err).marshal()})
+}
+
+// serveMultiplexed reads the frames of a connection of MultiplexVersion and later and serves its requests
+// concurrently, up to the maximum announced by the handshake. The requests are canceled once the connection fails.
+func (c *conn) serveMultiplexed(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	c.streams = make(map[uint32]*stream)
+	if !c.state.CompareAndSwap(int32(stateActive), int32(stateIdle)) {
+		// Closed by the server meanwhile
+		_ = c.rwc.Close()
+		return
+	}
+
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil || c.server.shuttingDown() {
+				_ = c.rwc.Close()
+				return
+			}
+			c.sendError(err)
+			c.close(fmt.Errorf("serveMultiplexed - readFrame: %w", err))
+			return
+		}
+
+		switch f.Type {
+		case FrameRequest:
+			err = c.openStream(ctx, f, &wg)
+		case FrameSolution:
+			err = c.route(f)
+		default:
+			err = fmt.Errorf("serveMultiplexed: %w: unexpected %s frame", ErrBadRequest, f.Type)
+		}
+		if err != nil {
+			c.sendError(err)
+			c.close(fmt.Errorf("serveMultiplexed: %w", err))
+			return
+		}
+	}
+}
+
+// openStream starts serving the request of the frame. Requests over the maximum of the connection,
+// or received once the server is shutting down, are refused with ErrServerBusy.
+func (c *conn) openStream(ctx context.Context, f *Frame, wg *sync.WaitGroup) error {
+	req, token, err := c.parseRequest(f)
+	if err != nil {
+		return fmt.Errorf("openStream - parseRequest: %w", err)
+	}
+	s := &stream{conn: c, id: f.ID, frames: make(chan *Frame, streamFrames)}
+	// The frame has been read entirely, so the request too large is refused alone
+	if err = c.checkRequestSize(req); err != nil {
+		s.fail(err)
+		return nil
+	}
+
+	c.mu.Lock()
+	if _, ok := c.streams[s.id]; ok {
+		c.mu.Unlock()
+		return fmt.Errorf("openStream: %w: request %d is already in flight", ErrBadRequest, s.id)
+	}
+	if len(c.streams) >= int(c.session.MaxConcurrent) || c.server.shuttingDown() {
+		c.mu.Unlock()
+		s.fail(&ServerError{Code: CodeServerBusy, Message: "too many concurrent requests"})
+		return nil
+	}
+	if len(c.streams) == 0 && !c.state.CompareAndSwap(int32(stateIdle), int32(stateActive)) {
+		// Closed by the server meanwhile
+		c.mu.Unlock()
+		return nil
+	}
+	c.streams[s.id] = s
+	c.mu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer c.closeStream(s)
+		defer c.recoverPanic()
+		c.serveRequest(ctx, s, req, token)
+	}()
+	return nil
+}
+
+// closeStream forgets the served request. The connection becomes idle once no requests are in flight.
+func (c *conn) closeStream(s *stream) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.streams, s.id)
+	if len(c.streams) == 0 {
+		c.state.CompareAndSwap(int32(stateActive), int32(stateIdle))
+	}
+}
+
+// route passes the frame to its request. Frames of requests which are no longer in flight, such as
+// a solution arriving after the challenge timed out, are dropped.
+func (c *conn) route(f *Frame) error {
+	c.mu.Lock()
+	s, ok := c.streams[f.ID]
+	c.mu.Unlock()
+	if !ok {
+		c.server.logger.Debugw("protocol: frame of an unknown request dropped", "conn", c.id, "request", f.ID, "type", f.Type)
+		return nil
+	}
+
+	select {
+	case s.frames <- f:
+		return nil
+	default:
+		return fmt.Errorf("route: %w: unexpected %s frame of request %d", ErrBadRequest, f.Type, f.ID)
+	}
+}
+
+// clientMux matches the frames of a connection of MultiplexVersion and later to the requests in flight.
+type clientMux struct {
+	enc *Encoder
+	dec *Decoder
+	// crProto - challenge-response protocol announced by the handshake of the connection, nil if PoW is disabled
+	crProto clientChallengeResponse
+	// sem - slots of the requests in flight, up to the maximum announced by the server
+	sem chan struct{}
+	// start - starts the reader with the first request
+	start sync.Once
+	// done is closed once the reader exits, err is the reason
+	done chan struct{}
+	err  error
+
+	// mu guards lastID and calls
+	mu sync.Mutex
+	// lastID - ID of the last request, 0 is never used
+	lastID uint32
+	// calls - frames of the requests in flight, by ID
+	calls map[uint32]chan *Frame
+}
+
+// newClientMux creates a new multiplexer of the requests of the connection.
+func newClientMux(enc *Encoder, dec *Decoder, crProto clientChallengeResponse, maxConcurrent uint16) *clientMux {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &clientMux{
+		enc:     enc,
+		dec:     dec,
+		crProto: crProto,
+		sem:     make(chan struct{}, maxConcurrent),
+		done:    make(chan struct{}),
+		calls:   make(map[uint32]chan *Frame),
+	}
+}
+
+// open registers a new request and returns its ID and the channel of its frames.
+// The reader of the connection is started with the first request.
+func (m *clientMux) open() (uint32, chan *Frame, error) {
+	m.start.Do(func() { go m.read() })
+	select {
+	case <-m.done:
+		return 0, nil, m.err
+	default:
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastID++
+	if m.lastID == 0 {
+		m.lastID++
+	}
+	frames := make(chan *Frame, streamFrames)
+	m.calls[m.lastID] = frames
+	return m.lastID, frames, nil
+}
+
+// close forgets the request, its frames received later are dropped.
+func (m *clientMux) close(id uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.calls, id)
+}
+
+// read passes the frames of the connection to their requests until the connection fails.
+func (m *clientMux) read() {
+	m.err = m.dispatch()
+	close(m.done)
+}
+
+// dispatch passes the frames of the connection to their requests, including the acknowledgements of their pings,
+// and answers pings.
+// It returns the error the connection fails with, including the errors of the connection sent by the server.
+func (m *clientMux) dispatch() error {
+	for {
+		f, err := m.dec.Decode()
+		if err != nil {
+			return fmt.Errorf("dispatch - Decode: %w", err)
+		}
+
+		switch {
+		case f.Type == FramePing && f.Flags&FlagAck == 0:
+			err = m.enc.Encode(&Frame{Type: FramePing, Flags: FlagAck, ID: f.ID, Payload: f.Payload})
+			if err != nil {
+				return fmt.Errorf("dispatch - Encode: %v", err)
+			}
+		case f.Type == FrameError && f.ID == 0:
+			serverErr, err := parseServerError(f.Payload)
+			if err != nil {
+				return fmt.Errorf("dispatch - parseServerError: %v", err)
+			}
+			return fmt.Errorf("dispatch: %w", serverErr)
+		default:
+			m.mu.Lock()
+			frames, ok := m.calls[f.ID]
+			m.mu.Unlock()
+			if !ok {
+				// The request has been abandoned
+				continue
+			}
+			select {
+			case frames <- f:
+			default:
+				return fmt.Errorf("dispatch: unexpected %s frame of request %d", f.Type, f.ID)
+			}
+		}
+	}
+}
+
+// recv returns the next frame of the request. The frames received before the connection failed are returned
+// before its error.
+func (m *clientMux) recv(ctx context.Context, frames chan *Frame) (*Frame, error) {
+	select {
+	case f := <-frames:
+		return f, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-m.done:
+		select {
+		case f := <-frames:
+			return f, nil
+		default:
+			return nil, m.err
+		}
+	}
+}
+
+// call exchanges the frames of the request with the server over the multiplexed connection and returns
+// the payload of the response. The challenge the server sends meanwhile is answered with a solution frame.
+func (c *Client) call(ctx context.Context, m *clientMux, req []byte) ([]byte, error) {
+	select {
+	case m.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-m.sem }()
+
+	id, frames, err := m.open()
+	if err != nil {
+		return nil, fmt.Errorf("call - open: %w", err)
+	}
+	defer m.close(id)
+
+	frame := &Frame{Type: FrameRequest, ID: id, Payload: req}
+	c.mu.Lock()
+	grant := c.access
+	token := c.accessToken()
+	c.mu.Unlock()
+	if token != nil {
+		frame.Flags = FlagAccessToken
+		frame.Payload, err = attachAccessToken(token, req)
+		if err != nil {
+			return nil, fmt.Errorf("call - attachAccessToken: %v", err)
+		}
+	}
+	err = m.enc.Encode(frame)
+	if err != nil {
+		return nil, fmt.Errorf("call - Encode: %v", err)
+	}
+
+	// solution - fresh solution sent to the server, kept to be redeemed after reconnecting if the connection
+	// fails before the response
+	var solution *response
+	for {
+		f, err := m.recv(ctx, frames)
+		if err != nil {
+			if solution != nil && !errors.Is(err, ctx.Err()) {
+				c.mu.Lock()
+				c.solution = solution
+				c.mu.Unlock()
+			}
+			return nil, fmt.Errorf("call - recv: %w", err)
+		}
+
+		switch f.Type {
+		case FrameChallenge:
+			if m.crProto == nil {
+				return nil, fmt.Errorf("call: challenge received, but PoW is disabled")
+			}
+			chal, err := m.crProto.parseChallengeParams(f.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("call - parseChallengeParams: %v", err)
+			}
+			// The server has not accepted the access token, and the pending solution of a lost connection
+			// is redeemed before solving the challenge
+			c.mu.Lock()
+			if token != nil && c.access == grant {
+				c.access = nil
+			}
+			pending := c.solution
+			c.solution = nil
+			c.mu.Unlock()
+			if pending == nil || pending.expired() {
+				pending, err = m.crProto.solveContext(ctx, chal, c.solver)
+				if err != nil {
+					return nil, fmt.Errorf("call - solveContext: %w", err)
+				}
+				solution = pending
+			}
+			err = m.enc.Encode(&Frame{Type: FrameSolution, ID: id, Payload: pending.payload()})
+			if err != nil {
+				return nil, fmt.Errorf("call - Encode: %v", err)
+			}
+		case FrameAccess:
+			grant, err := parseAccessGrant(f.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("call - parseAccessGrant: %v", err)
+			}
+			c.mu.Lock()
+			c.access = grant
+			c.mu.Unlock()
+		case FrameResponse:
+			return f.Payload, nil
+		case FrameError:
+			serverErr, err := parseServerError(f.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("call - parseServerError: %v", err)
+			}
+			return nil, fmt.Errorf("call: %w", serverErr)
+		default:
+			return nil, fmt.Errorf("call: unexpected %s frame", f.Type)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_RequestIDs(t *testing.T) {
+	buf := new(bytes.Buffer)
+	enc := NewEncoder(buf, 1024, false)
+	enc.EnableRequestIDs()
+	dec := NewDecoder(buf, 1024)
+	dec.EnableRequestIDs()
+
+	frame := &Frame{Type: FrameRequest, ID: 1 << 31, Payload: []byte(CmdGetQuote)}
+	require.NoError(t, enc.Encode(frame))
+	require.Equal(t, frameHeaderLen+frameIDLen+len(CmdGetQuote), buf.Len())
+	f, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, frame, f)
+}
+
+func TestServer_Multiplexing(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	const requests = 4
+
+	// The handler answers once every request is in flight, so they are served concurrently
+	var arrived sync.WaitGroup
+	arrived.Add(requests)
+	server := NewServer(logger.Sugar(), NewProofOfWork(8, time.Second*10), time.Second*60,
+		func(ctx context.Context, request *Request) (*Response, error) {
+			arrived.Done()
+			arrived.Wait()
+			response := Response(strings.TrimPrefix(string(*request), "Echo "))
+			return &response, nil
+		}, WithMaxConcurrentRequests(requests))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	require.Equal(t, uint16(requests), c.Session().MaxConcurrent)
+
+	// Every caller gets the response to its own request
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := fmt.Sprint("message-", i)
+			res, err := c.Do(context.Background(), "Echo", want)
+			if err == nil && res != want {
+				err = fmt.Errorf("got %q, want %q", res, want)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestServer_MaxConcurrentRequests(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	release := make(chan struct{})
+	handler := func(ctx context.Context, request *Request) (*Response, error) {
+		if *request == "Fail" {
+			return nil, ErrNotFound
+		}
+		<-release
+		response := Response("Test quote")
+		return &response, nil
+	}
+
+	server := NewServer(logger.Sugar(), nil, time.Second*60, handler, WithMaxConcurrentRequests(1))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+
+	// The requests over the maximum of the connection are refused, the connection stays open
+	require.NoError(t, c.enc.Encode(&Frame{Type: FrameRequest, ID: 1, Payload: []byte(CmdGetQuote)}))
+	require.NoError(t, c.enc.Encode(&Frame{Type: FrameRequest, ID: 2, Payload: []byte(CmdGetQuote)}))
+	f, err := c.dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, FrameError, f.Type)
+	require.Equal(t, uint32(2), f.ID)
+	serverErr, err := parseServerError(f.Payload)
+	require.NoError(t, err)
+	require.ErrorIs(t, serverErr, ErrServerBusy)
+
+	close(release)
+	f, err = c.dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, &Frame{Type: FrameResponse, ID: 1, Payload: []byte("Test quote")}, f)
+
+	// Errors of the handler end only their request
+	_, err = c.Do(context.Background(), "Fail")
+	require.ErrorIs(t, err, ErrNotFound)
+	quote, err := c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, "Test quote", quote)
+}
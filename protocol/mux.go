@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CmdGetQuote - the command requesting a random quote, sent by Client.GetQuote and by the clients of version 0.
+// The other commands are defined by the handlers registered with the server.
+const CmdGetQuote = "GetQuote"
+
+// Command returns the name of the command of the request, which is its first word.
+func (r *Request) Command() string {
+	fields := strings.Fields(string(*r))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// Args returns the arguments of the command of the request, which are the words following its name.
+func (r *Request) Args() []string {
+	fields := strings.Fields(string(*r))
+	if len(fields) == 0 {
+		return nil
+	}
+	return fields[1:]
+}
+
+// Mux dispatches requests to the handlers registered for their commands.
+// A request is the name of the command followed by its arguments, separated by whitespace.
+type Mux struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewMux creates a new empty mux.
+func NewMux() *Mux {
+	return &Mux{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for the command. It panics if the name is not a single word
+// or a handler is already registered for it.
+func (m *Mux) Handle(command string, handler Handler) {
+	if command == "" || len(strings.Fields(command)) != 1 || strings.TrimSpace(command) != command {
+		panic(fmt.Sprintf("protocol: invalid command name %q", command))
+	}
+	if handler == nil {
+		panic("protocol: nil handler")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.handlers[command]; ok {
+		panic(fmt.Sprintf("protocol: multiple registrations for %s", command))
+	}
+	m.handlers[command] = handler
+}
+
+// Serve dispatches the request to the handler of its command, it is the Handler of the mux.
+// Requests of unknown commands get ErrUnknownCommand.
+func (m *Mux) Serve(ctx context.Context, req *Request) (*Response, error) {
+	command := req.Command()
+
+	m.mu.RLock()
+	handler, ok := m.handlers[command]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, errUnknownCommand(command)
+	}
+	return handler(ctx, req)
+}
+
+// Handles reports whether a handler is registered for the command.
+func (m *Mux) Handles(command string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.handlers[command]
+	return ok
+}
+
+// WithCommands makes the server refuse the requests of the commands the handler does not serve with
+// ErrUnknownCommand before the clients are challenged, e.g. WithCommands(mux.Handles).
+func WithCommands(handles func(command string) bool) ServerOption {
+	return func(s *Server) {
+		s.commands = handles
+	}
+}
+
+// errUnknownCommand returns the error refusing the requests of the command no handler is registered for.
+func errUnknownCommand(command string) error {
+	return &ServerError{Code: CodeUnknownCommand, Message: fmt.Sprintf("unknown command %q", command)}
+}
@@ -0,0 +1,202 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequest_Command(t *testing.T) {
+	req := Request("GetQuoteByID  42\tx\n")
+	require.Equal(t, "GetQuoteByID", req.Command())
+	require.Equal(t, []string{"42", "x"}, req.Args())
+
+	req = Request("\n")
+	require.Equal(t, "", req.Command())
+	require.Empty(t, req.Args())
+}
+
+func TestMux_Handle(t *testing.T) {
+	mux := NewMux()
+	handler := func(ctx context.Context, request *Request) (*Response, error) { return nil, nil }
+	mux.Handle(CmdGetQuote, handler)
+
+	require.Panics(t, func() { mux.Handle(CmdGetQuote, handler) })
+	require.Panics(t, func() { mux.Handle("", handler) })
+	require.Panics(t, func() { mux.Handle("Get Quote", handler) })
+	require.Panics(t, func() { mux.Handle("Echo", nil) })
+}
+
+func TestClient_Do(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	mux := NewMux()
+	mux.Handle(CmdGetQuote, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	mux.Handle("Echo", func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response(strings.Join(request.Args(), ","))
+		return &response, nil
+	})
+
+	server := NewServer(logger.Sugar(), NewProofOfWork(8, time.Second*10), time.Second*60, mux.Serve)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	for _, legacy := range []bool{false, true} {
+		var opts []ClientOption
+		if legacy {
+			opts = append(opts, WithLegacyHandshake())
+		}
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		c, err := NewClient(conn, opts...)
+		require.NoError(t, err)
+
+		quote, err := c.GetQuote()
+		require.NoError(t, err)
+		require.Equal(t, "Test quote", quote)
+
+		res, err := c.Do(context.Background(), "Echo", "a", "b")
+		require.NoError(t, err)
+		require.Equal(t, "a,b", res)
+
+		_, err = c.Do(context.Background(), "Echo", "a b")
+		require.Error(t, err)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.Do(context.Background(), "Unknown")
+	require.ErrorIs(t, err, ErrUnknownCommand)
+}
+
+func TestServer_RecoverableErrors(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	mux := NewMux()
+	mux.Handle(CmdGetQuote, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	mux.Handle("Find", func(ctx context.Context, request *Request) (*Response, error) {
+		return nil, ErrNotFound
+	})
+	mux.Handle("Fail", func(ctx context.Context, request *Request) (*Response, error) {
+		return nil, errors.New("database is down")
+	})
+
+	server := NewServer(logger.Sugar(), nil, time.Second*60, mux.Serve)
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	// The connection of a framed client is left open after the errors caused by its requests
+	enc, dec := testHandshake(t, l.Addr().String(), AccessTokenVersion)
+	for _, req := range []string{"Unknown", "Find 1", "Get Quote"} {
+		require.NoError(t, enc.Encode(&Frame{Type: FrameRequest, Payload: []byte(req)}))
+		f, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, FrameError, f.Type, req)
+		serverErr, err := parseServerError(f.Payload)
+		require.NoError(t, err)
+		require.True(t, serverErr.recoverable(), req)
+	}
+	require.NoError(t, enc.Encode(&Frame{Type: FrameRequest, Payload: []byte(CmdGetQuote)}))
+	f, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, FrameResponse, f.Type)
+	require.Equal(t, "Test quote", string(f.Payload))
+
+	// It is closed after an internal error
+	require.NoError(t, enc.Encode(&Frame{Type: FrameRequest, Payload: []byte("Fail")}))
+	f, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, FrameError, f.Type)
+	_, err = dec.Decode()
+	require.Error(t, err)
+}
+
+func TestServer_UnknownCommand(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	mux := NewMux()
+	mux.Handle(CmdGetQuote, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	require.True(t, mux.Handles(CmdGetQuote))
+	require.False(t, mux.Handles("Unknown"))
+
+	// The challenges are too hard to be solved within the test, so the requests must be refused before them
+	server := NewServer(logger.Sugar(), NewProofOfWork(40, time.Second*10), time.Second*60, mux.Serve, WithCommands(mux.Handles))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// A multiplexed connection refuses the request alone
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, "Unknown")
+	require.ErrorIs(t, err, ErrUnknownCommand)
+	_, err = c.Do(ctx, "Unknown", "1")
+	require.ErrorIs(t, err, ErrUnknownCommand)
+
+	// A framed connection is told and left open
+	enc, dec := testHandshake(t, l.Addr().String(), AccessTokenVersion)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, enc.Encode(&Frame{Type: FrameRequest, Payload: []byte("Unknown")}))
+		f, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, FrameError, f.Type)
+		serverErr, err := parseServerError(f.Payload)
+		require.NoError(t, err)
+		require.Equal(t, CodeUnknownCommand, serverErr.Code)
+	}
+
+	// A line connection is closed instead of challenged
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err = NewClient(conn, WithLegacyHandshake())
+	require.NoError(t, err)
+	_, err = c.Do(ctx, "Unknown")
+	require.Error(t, err)
+	require.NoError(t, ctx.Err())
+}
+
+// testHandshake performs the handshake of a client supporting only the version, which must be framed,
+// and returns the encoder and the decoder of its frames.
+func testHandshake(t *testing.T, addr string, version uint8) (*Encoder, *Decoder) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	h := &hello{versions: []uint8{version}, algorithms: Algorithms(), maxFrameSize: DefaultMaxFrameSize}
+	require.NoError(t, writeMessage(conn, helloMagic, h.marshal()))
+	reader := bufio.NewReader(conn)
+	require.NoError(t, readMagic(reader, welcomeMagic))
+	f, err := readFields(reader)
+	require.NoError(t, err)
+	session, err := parseWelcome(f)
+	require.NoError(t, err)
+	require.Equal(t, version, session.Version)
+
+	enc, dec := NewEncoder(conn, session.MaxFrameSize, false), NewDecoder(reader, session.MaxFrameSize)
+	if version >= MultiplexVersion {
+		enc.EnableRequestIDs()
+		dec.EnableRequestIDs()
+	}
+	return enc, dec
+}
@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// pingPayloadLen - len of the random payload of the pings sent by Ping, matching the acknowledgement to the ping.
+const pingPayloadLen = 8
+
+// ErrPingUnsupported is returned by Ping if the session precedes FramedVersion, which has no ping frames.
+var ErrPingUnsupported = errors.New("ping is not supported by the protocol version")
+
+// Ping sends a ping frame to the server and returns the round-trip time once the server acknowledges it.
+// Pings are answered without a challenge, so they probe the liveness of the server cheaply. The ping is
+// interrupted when ctx is done, as GetQuoteContext describes.
+func (c *Client) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	payload := make([]byte, pingPayloadLen)
+	_, err = rand.Read(payload)
+	if err != nil {
+		return 0, fmt.Errorf("Ping - Read: %v", err)
+	}
+
+	c.mu.Lock()
+	if !c.framed() {
+		c.mu.Unlock()
+		return 0, fmt.Errorf("Ping: %w", ErrPingUnsupported)
+	}
+	if m := c.mux; m != nil {
+		c.mu.Unlock()
+		rtt, err = m.ping(ctx, payload)
+	} else {
+		err = c.withContext(ctx, func() error {
+			rtt, err = c.ping(payload)
+			return err
+		})
+		c.mu.Unlock()
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Ping: %w", err)
+	}
+	return rtt, nil
+}
+
+// ping exchanges the ping and its acknowledgement with the server, answering the pings of the server meanwhile.
+func (c *Client) ping(payload []byte) (time.Duration, error) {
+	start := time.Now()
+	err := c.enc.Encode(&Frame{Type: FramePing, Payload: payload})
+	if err != nil {
+		return 0, fmt.Errorf("ping - Encode: %v", err)
+	}
+
+	for {
+		f, err := c.dec.Decode()
+		if err != nil {
+			return 0, fmt.Errorf("ping - Decode: %w", err)
+		}
+		if f.Type != FramePing {
+			return 0, fmt.Errorf("ping: unexpected %s frame", f.Type)
+		}
+		if f.Flags&FlagAck != 0 {
+			if !bytes.Equal(f.Payload, payload) {
+				return 0, fmt.Errorf("ping: acknowledgement of another ping")
+			}
+			return time.Since(start), nil
+		}
+		err = c.enc.Encode(&Frame{Type: FramePing, Flags: FlagAck, ID: f.ID, Payload: f.Payload})
+		if err != nil {
+			return 0, fmt.Errorf("ping - Encode: %v", err)
+		}
+	}
+}
+
+// ping sends the ping with the ID of a new request over the multiplexed connection, so its acknowledgement
+// is passed back to it. Pings do not count as requests in flight.
+func (m *clientMux) ping(ctx context.Context, payload []byte) (time.Duration, error) {
+	id, frames, err := m.open()
+	if err != nil {
+		return 0, fmt.Errorf("ping - open: %w", err)
+	}
+	defer m.close(id)
+
+	start := time.Now()
+	err = m.enc.Encode(&Frame{Type: FramePing, ID: id, Payload: payload})
+	if err != nil {
+		return 0, fmt.Errorf("ping - Encode: %v", err)
+	}
+	f, err := m.recv(ctx, frames)
+	if err != nil {
+		return 0, fmt.Errorf("ping - recv: %w", err)
+	}
+	if f.Type != FramePing || !bytes.Equal(f.Payload, payload) {
+		return 0, fmt.Errorf("ping: unexpected %s frame", f.Type)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_Ping(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	server := NewServer(logger.Sugar(), NewProofOfWork(30, time.Second*10), time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	dial := func(opts ...ClientOption) *Client {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		c, err := NewClient(conn, opts...)
+		require.NoError(t, err)
+		return c
+	}
+
+	// Pings are answered without the challenge, which would take long to solve
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c := dial()
+	rtt, err := c.Ping(ctx)
+	require.NoError(t, err)
+	require.Positive(t, rtt)
+	_, err = c.Ping(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), server.Stats().Requests)
+
+	// The lockstep exchange of the versions preceding MultiplexVersion
+	c = dial()
+	c.mux = nil
+	_, err = c.Ping(ctx)
+	require.NoError(t, err)
+
+	_, err = dial(WithLegacyHandshake()).Ping(ctx)
+	require.ErrorIs(t, err, ErrPingUnsupported)
+}
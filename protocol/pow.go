@@ -3,8 +3,10 @@ package protocol
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"math"
@@ -12,6 +14,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +25,16 @@ const (
 	del = '|'
 	// hashBitLen - const representing len of sha checksum in bits.
 	hashBitLen = 256
+	// maxDifficulty - the highest difficulty in bits, leaving at least one acceptable hash.
+	maxDifficulty = hashBitLen - 1
+	// targetLen - len of a target transmitted as the largest acceptable hash in bytes.
+	targetLen = hashBitLen / 8
+	// difficultyPrecision - difficulties are rounded to a millionth of a bit, so repeated steps do not accumulate
+	// floating point errors.
+	difficultyPrecision = 1e6
+	// defaultChallengeTTL - default time during which the solution of a challenge is accepted.
+	// It allows a client to redeem a solved challenge after reconnecting.
+	defaultChallengeTTL = 5 * time.Minute
 )
 
 // PowError represents an error encountered during Proof of Work.
@@ -32,77 +45,184 @@ type PowError struct {
 
 func (e *PowError) Error() string { return e.msg }
 
+var (
+	// ErrChallengeExpired is returned when the solution is received after the challenge expired.
+	ErrChallengeExpired = &PowError{"challenge is expired"}
+	// ErrChallengeReplayed is returned when the solution has already been accepted.
+	ErrChallengeReplayed = &PowError{"challenge is already solved"}
+	// ErrUnsolvable is returned by the solver when no nonce of the search space gives a hash less than the target.
+	ErrUnsolvable = &PowError{"challenge is unsolvable: nonce space is exhausted"}
+)
+
 // ProofOfWork represents the Proof of Work algorithm configuration.
 type ProofOfWork struct {
-	// targetBits the target number of requested leading zeros in the hash
-	targetBits uint8
+	// difficulty - the expected work in bits, log2 of the expected number of hashes. Fractional bits
+	// tune the work in steps finer than doubling it
+	difficulty float64
+	// step - the difficulty IncreaseComplexity and DecreaseComplexity change it by
+	step float64
 
 	// target is another name for the requirements described in the previous section.
 	// We use big integer because of the way the hash is compared to the target: we convert the hash to a big integer and check if it is less than the target.
-	// In the NewProofOfWork function, we initialize big.Int to 1 and then shift it by 256-targetBits bits.
-	// 256 is the length of the SHA-256 hash in bits, and we will use this hashing algorithm. Hex representation of target:
+	// The target is 2^(256-difficulty), so whole bits of difficulty require leading zeros in the hash,
+	// while fractional ones give arbitrary thresholds between them.
 	target *big.Int
 
-	// readTimeout - server timeout for waiting for a response
-	readTimeout time.Duration
+	// readTimeout - server timeout for waiting for a response, a time.Duration which may be changed at runtime
+	readTimeout atomic.Int64
 
-	// targetLock - mutex for server changing of target and targetBits.
+	// targetLock - mutex for server changing of target and difficulty.
 	targetLock sync.RWMutex
+
+	// alg - hash function the puzzle is built on
+	alg Algorithm
+
+	// secret - HMAC key challenges are signed with. A random key is generated if none is set.
+	secret     []byte
+	secretOnce sync.Once
+	secretErr  error
+
+	// challengeTTL - time during which the solution of a challenge is accepted
+	challengeTTL time.Duration
+	// replay - accepted solutions which must not be accepted again
+	replay *replayCache
+	// metrics - recorder of the verifications and the difficulty
+	metrics Metrics
+}
+
+// PowOption configures optional parameters of the Proof of Work.
+type PowOption func(*ProofOfWork)
+
+// WithAlgorithm sets the hash function of the puzzle. SHA-256 is used by default.
+func WithAlgorithm(alg Algorithm) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.alg = alg
+	}
+}
+
+// WithSecret sets the HMAC key challenges are signed with.
+// Servers sharing the key accept solutions of each other's challenges.
+func WithSecret(secret []byte) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.secret = secret
+	}
+}
+
+// WithChallengeTTL sets the time during which the solution of a challenge is accepted. The default is 5 minutes.
+func WithChallengeTTL(ttl time.Duration) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.challengeTTL = ttl
+	}
+}
+
+// WithReplayCacheSize sets the maximum number of accepted solutions remembered to reject their replays.
+// Solutions are remembered until their challenges expire; when the cache is full the oldest one is forgotten,
+// and the solutions of the challenges expiring no later than it are refused with ErrChallengeExpired.
+func WithReplayCacheSize(size int) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.replay = newReplayCache(size)
+	}
+}
+
+// WithDifficulty sets the difficulty in bits, overriding the target bits of NewProofOfWork.
+// Fractional bits set the expected work between two powers of two.
+func WithDifficulty(bits float64) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.difficulty = clampDifficulty(bits)
+		pow.target = targetFromDifficulty(pow.difficulty)
+	}
+}
+
+// WithDifficultyStep sets the difficulty in bits IncreaseComplexity and DecreaseComplexity change it by.
+// The default is one bit, doubling or halving the expected work.
+func WithDifficultyStep(step float64) PowOption {
+	return func(pow *ProofOfWork) {
+		pow.step = step
+	}
 }
 
 // NewProofOfWork creates a new Proof of Work configuration.
-func NewProofOfWork(targetBits uint8, readTimeout time.Duration) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, hashBitLen-uint(targetBits))
-	return &ProofOfWork{target: target, targetBits: targetBits, readTimeout: readTimeout}
+func NewProofOfWork(targetBits uint8, readTimeout time.Duration, opts ...PowOption) *ProofOfWork {
+	pow := &ProofOfWork{
+		target:       targetFromBits(targetBits),
+		difficulty:   float64(targetBits),
+		step:         1,
+		alg:          sha256Algorithm{},
+		challengeTTL: defaultChallengeTTL,
+		metrics:      nopMetrics{},
+	}
+	pow.readTimeout.Store(int64(readTimeout))
+	for _, opt := range opts {
+		opt(pow)
+	}
+	if pow.replay == nil {
+		pow.replay = newReplayCache(defaultReplayCacheSize)
+	}
+	pow.metrics.DifficultyChanged(pow.difficulty)
+	return pow
 }
 
 // ChallengeResponse performs the Proof of Work challenge-response protocol.
+// The challenge is a signed token bound to the client data, so the response is verified without the issued challenge
+// and may be a solution of a challenge issued on another connection.
 func (pow *ProofOfWork) ChallengeResponse(conn net.Conn, data []byte) error {
-	rnd, err := rand.Int(rand.Reader, big.NewInt(math.MaxUint32))
-	if err != nil {
-		return fmt.Errorf("ChallengeResponse - Int: %v", err)
+	return pow.ChallengeResponseContext(context.Background(), conn, data)
+}
+
+// ChallengeResponseContext performs the Proof of Work challenge-response protocol. The response is awaited until
+// the read timeout or the deadline of ctx, whichever comes first, and the exchange is interrupted when ctx is done.
+func (pow *ProofOfWork) ChallengeResponseContext(ctx context.Context, conn net.Conn, data []byte) error {
+	return pow.challengeResponse(ctx, conn, data, pow.Difficulty(), false)
+}
+
+// challengeResponse performs the Proof of Work challenge-response protocol with a challenge of the difficulty.
+// Clients of version 0 respond without the solved token, so if legacy is set the response is read in their format
+// and verified against the challenge issued here.
+func (pow *ProofOfWork) challengeResponse(ctx context.Context, conn net.Conn, data []byte, difficulty float64, legacy bool) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("challengeResponse: %w", err)
 	}
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
 
-	chal := pow.newChallenge(data, uint32(rnd.Int64()))
+	chal, err := pow.issueChallenge(data, difficulty)
+	if err != nil {
+		return fmt.Errorf("challengeResponse - issueChallenge: %v", err)
+	}
 
 	_, err = conn.Write(chal.marshal())
 	if err != nil {
-		return fmt.Errorf("ChallengeResponse: Write error: %v", err)
+		return fmt.Errorf("challengeResponse: Write error: %v", err)
 	}
 
-	if pow.readTimeout != 0 {
-		err = conn.SetReadDeadline(time.Now().Add(pow.readTimeout))
+	if deadline := readDeadline(ctx, pow.ReadTimeout()); !deadline.IsZero() {
+		err = conn.SetReadDeadline(deadline)
 		if err != nil {
-			return fmt.Errorf("ChallengeResponse: SetReadDeadline error: %v", err)
+			return fmt.Errorf("challengeResponse: SetReadDeadline error: %v", err)
 		}
 	}
 
-	resp, err := pow.readResponse(bufio.NewReader(conn))
+	read := pow.readResponse
+	if legacy {
+		read = pow.readLegacyResponse
+	}
+	resp, err := read(bufio.NewReader(conn))
 	if err != nil {
-		return fmt.Errorf("ChallengeResponse - readResponse: %v", err)
+		if ctx.Err() != nil {
+			return fmt.Errorf("challengeResponse - readResponse: %w", ctx.Err())
+		}
+		return fmt.Errorf("challengeResponse - readResponse: %w", err)
 	}
-
-	pow.targetLock.RLock()
-	if !pow.validate(resp) || !pow.compare(chal, resp) {
-		pow.targetLock.RUnlock()
-		return &PowError{"response is not valid"}
+	if legacy {
+		resp.challenge = chal.data
 	}
-	pow.targetLock.RUnlock()
-	return nil
+
+	return pow.verify(data, resp)
 }
 
-// SolveChallenge performs the Proof of Work challenge-solving protocol.
+// SolveChallenge performs the Proof of Work challenge-solving protocol with the SHA-256 algorithm.
 func SolveChallenge(conn net.Conn, targetBits uint8) error {
-	target := big.NewInt(1)
-	target.Lsh(target, hashBitLen-uint(targetBits))
-
-	pow := &ProofOfWork{
-		target:     target,
-		targetBits: targetBits,
-	}
-
-	return pow.SolveChallenge(conn)
+	return NewProofOfWork(targetBits, 0).SolveChallenge(conn)
 }
 
 // SolveChallenge performs the Proof of Work challenge-solving protocol.
@@ -112,14 +232,9 @@ func (pow *ProofOfWork) SolveChallenge(conn net.Conn) error {
 		return fmt.Errorf("SolveChallenge - readChallenge: %v", err)
 	}
 
-	resp := pow.newResponse(nil, 0)
-	for resp.nonce < math.MaxInt32 {
-		resp.hash = pow.computeHash(chal.data, resp.nonce)
-		if pow.validate(resp) {
-			break
-		} else {
-			resp.nonce++
-		}
+	resp, err := pow.solve(chal)
+	if err != nil {
+		return fmt.Errorf("SolveChallenge - solve: %w", err)
 	}
 
 	_, err = conn.Write(resp.marshal())
@@ -130,25 +245,120 @@ func (pow *ProofOfWork) SolveChallenge(conn net.Conn) error {
 	return nil
 }
 
+// solve searches the whole nonce space for the nonce giving a hash of the challenge less than the target.
+func (pow *ProofOfWork) solve(chal *challenge) (*response, error) {
+	return pow.search(context.Background(), chal, 0, math.MaxUint64, new(atomic.Uint64))
+}
+
+// search looks for the nonce giving a hash of the challenge less than the target in the range [first, last].
+// It returns ErrUnsolvable if there is no such nonce in the range and the error of ctx if ctx is done first.
+// Computed hashes are added to the counter.
+func (pow *ProofOfWork) search(ctx context.Context, chal *challenge, first, last uint64, hashes *atomic.Uint64) (*response, error) {
+	target := pow.challengeTarget(chal)
+	alg := pow.challengeAlgorithm(chal)
+
+	resp := pow.newResponse(chal.data, nil, first)
+	for batch := uint64(1); ; batch++ {
+		resp.hash = computeHash(alg, chal.data, resp.nonce)
+		if meetsTarget(resp.hash, target) {
+			hashes.Add(batch)
+			return resp, nil
+		}
+		if resp.nonce == last {
+			hashes.Add(batch)
+			return nil, ErrUnsolvable
+		}
+		resp.nonce++
+
+		if batch == searchBatch {
+			hashes.Add(batch)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			batch = 0
+		}
+	}
+}
+
+// verify checks the signature, client binding and expiry of the solved challenge and the solution itself.
+// The solution is checked against the complexity the challenge was issued with and is accepted only once.
+func (pow *ProofOfWork) verify(data []byte, r *response) (err error) {
+	start := time.Now()
+	defer func() { pow.metrics.Verified(time.Since(start), err) }()
+
+	key, err := pow.key()
+	if err != nil {
+		return fmt.Errorf("verify - key: %v", err)
+	}
+
+	t, err := parseToken(r.challenge, key)
+	if err != nil || !t.boundTo(data) {
+		return ErrInvalidSolution
+	}
+	now := time.Now()
+	if now.After(t.expires) {
+		return ErrChallengeExpired
+	}
+	if !meetsTarget(r.hash, t.target) || !pow.compare(r) {
+		return ErrInvalidSolution
+	}
+	return pow.replay.add(replayKey(r), t.expires, now)
+}
+
+// key returns the HMAC key challenges are signed with, generating a random one on first use if none was set.
+func (pow *ProofOfWork) key() ([]byte, error) {
+	pow.secretOnce.Do(func() {
+		if pow.secret == nil {
+			pow.secret = make([]byte, secretLen)
+			_, pow.secretErr = rand.Read(pow.secret)
+		}
+	})
+	return pow.secret, pow.secretErr
+}
+
 // challenge represents a Proof of Work challenge.
 type challenge struct {
 	pow *ProofOfWork
 
 	data []byte
+
+	// target - target of the challenge, known if alg is set
+	target *big.Int
+	// alg - hash function of the challenge, nil if the challenge was received without its parameters
+	alg Algorithm
 }
 
-// newChallenge creates a new challenge.
-func (pow *ProofOfWork) newChallenge(data []byte, rnd uint32) *challenge {
-	return &challenge{
-		pow: pow,
-		data: bytes.Join(
-			[][]byte{
-				data,
-				i32tob(rnd),
-			},
-			[]byte{},
-		),
+// newChallenge creates a new challenge signed token of the current difficulty bound to the client data.
+func (pow *ProofOfWork) newChallenge(data []byte) (*challenge, error) {
+	return pow.issueChallenge(data, pow.Difficulty())
+}
+
+// issueChallenge creates a new challenge signed token of the difficulty bound to the client data.
+func (pow *ProofOfWork) issueChallenge(data []byte, difficulty float64) (*challenge, error) {
+	key, err := pow.key()
+	if err != nil {
+		return nil, fmt.Errorf("issueChallenge - key: %v", err)
+	}
+
+	now := time.Now()
+	target := targetFromDifficulty(difficulty)
+	t := &token{
+		target:  target,
+		issued:  now,
+		expires: now.Add(pow.challengeTTL),
+		binding: clientBinding(data),
 	}
+	_, err = rand.Read(t.salt[:])
+	if err != nil {
+		return nil, fmt.Errorf("issueChallenge - Read: %v", err)
+	}
+
+	return &challenge{
+		pow:    pow,
+		data:   t.sign(key),
+		target: target,
+		alg:    pow.alg,
+	}, nil
 }
 
 // readChallenge read data from bufio.Reader to a challenge.
@@ -159,6 +369,11 @@ func (pow *ProofOfWork) readChallenge(reader *bufio.Reader) (*challenge, error)
 	}
 	data = data[:len(data)-1]
 
+	err = readTrailer(reader)
+	if err != nil {
+		return nil, fmt.Errorf("readChallenge - readTrailer: %v", err)
+	}
+
 	return &challenge{
 		pow:  pow,
 		data: data,
@@ -177,44 +392,139 @@ func (c *challenge) marshal() []byte {
 	)
 }
 
+// parseChallenge reads a challenge from the payload of a challenge frame.
+func (pow *ProofOfWork) parseChallenge(payload []byte) (*challenge, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("parseChallenge: empty challenge")
+	}
+	return &challenge{
+		pow:  pow,
+		data: payload,
+	}, nil
+}
+
+// payload returns the challenge as the payload of a challenge frame, which is the signed token.
+func (c *challenge) payload() []byte {
+	return c.data
+}
+
+// parseChallengeParams reads a challenge from the payload of a challenge frame announcing its parameters,
+// sent since ChallengeParamsVersion.
+func (pow *ProofOfWork) parseChallengeParams(payload []byte) (*challenge, error) {
+	f, err := parseFields(payload)
+	if err != nil {
+		return nil, fmt.Errorf("parseChallengeParams - parseFields: %v", err)
+	}
+	if len(f[challengeToken]) == 0 || len(f[challengeTargetBits]) != 1 {
+		return nil, fmt.Errorf("parseChallengeParams: invalid challenge")
+	}
+	alg, err := LookupAlgorithm(string(f[challengeAlgorithm]))
+	if err != nil {
+		return nil, fmt.Errorf("parseChallengeParams - LookupAlgorithm: %v", err)
+	}
+
+	// The exact target is preferred, the whole bits are sent for peers not knowing it
+	target := targetFromBits(f[challengeTargetBits][0])
+	if b, ok := f[challengeTarget]; ok {
+		target, err = parseTarget(b)
+		if err != nil {
+			return nil, fmt.Errorf("parseChallengeParams - parseTarget: %v", err)
+		}
+	}
+	return &challenge{
+		pow:    pow,
+		data:   f[challengeToken],
+		target: target,
+		alg:    alg,
+	}, nil
+}
+
+// paramsPayload returns the challenge as the payload of a challenge frame announcing its parameters:
+// the signed token, the name of the hash function, the target and the difficulty rounded up to whole bits.
+func (c *challenge) paramsPayload() ([]byte, error) {
+	return fields{
+		challengeToken:      c.data,
+		challengeAlgorithm:  []byte(c.alg.Name()),
+		challengeTargetBits: {bitsOf(c.target)},
+		challengeTarget:     marshalTarget(c.target),
+	}.marshal()
+}
+
 // response represents a Proof of Work response.
 type response struct {
 	pow *ProofOfWork
 
-	hash  []byte
-	nonce uint32
+	// challenge - the solved challenge token
+	challenge []byte
+	hash      []byte
+	nonce     uint64
 }
 
 // newResponse creates a new response.
-func (pow *ProofOfWork) newResponse(hash []byte, nonce uint32) *response {
+func (pow *ProofOfWork) newResponse(challenge, hash []byte, nonce uint64) *response {
 	return &response{
-		hash:  hash,
-		nonce: nonce,
-		pow:   pow,
+		challenge: challenge,
+		hash:      hash,
+		nonce:     nonce,
+		pow:       pow,
 	}
 }
 
 // readResponse read data from bufio.Reader to a response.
 func (pow *ProofOfWork) readResponse(reader *bufio.Reader) (*response, error) {
+	resp, err := pow.readSolution(reader)
+	if err != nil {
+		return nil, fmt.Errorf("readResponse - readSolution: %w", err)
+	}
+
+	chal, err := reader.ReadBytes(del)
+	if err != nil {
+		return nil, fmt.Errorf("readResponse - ReadSlice: %w", err)
+	}
+	resp.challenge = chal[:len(chal)-1]
+
+	err = readTrailer(reader)
+	if err != nil {
+		return nil, fmt.Errorf("readResponse - readTrailer: %w", err)
+	}
+	return resp, nil
+}
+
+// readLegacyResponse read data from bufio.Reader to a response of a version 0 client, which carries no token.
+func (pow *ProofOfWork) readLegacyResponse(reader *bufio.Reader) (*response, error) {
+	resp, err := pow.readSolution(reader)
+	if err != nil {
+		return nil, fmt.Errorf("readLegacyResponse - readSolution: %w", err)
+	}
+
+	err = readTrailer(reader)
+	if err != nil {
+		return nil, fmt.Errorf("readLegacyResponse - readTrailer: %w", err)
+	}
+	return resp, nil
+}
+
+// readSolution reads the hash and the nonce parts of a response, each followed by the delimiter.
+func (pow *ProofOfWork) readSolution(reader *bufio.Reader) (*response, error) {
 	hash := make([]byte, sha256.Size)
 	_, err := io.ReadFull(reader, hash)
 	if err != nil {
-		return nil, fmt.Errorf("readResponse - ReadFull: %v", err)
+		return nil, fmt.Errorf("readSolution - ReadFull: %w", err)
 	}
 	_, err = reader.ReadByte()
 	if err != nil {
-		return nil, fmt.Errorf("readResponse - ReadByte: %v", err)
+		return nil, fmt.Errorf("readSolution - ReadByte: %w", err)
 	}
 
 	nonce, err := reader.ReadBytes(del)
 	if err != nil {
-		return nil, fmt.Errorf("readResponse - ReadSlice: %v", err)
+		return nil, fmt.Errorf("readSolution - ReadSlice: %w", err)
 	}
 	nonce = nonce[:len(nonce)-1]
 
-	iNonce, err := btoi32(nonce)
+	iNonce, err := btoi64(nonce)
 	if err != nil {
-		return nil, fmt.Errorf("readResponse - btoi32: %v", err)
+		return nil, fmt.Errorf("readSolution - btoi64: %v", err)
 	}
 
 	return &response{
@@ -224,11 +534,31 @@ func (pow *ProofOfWork) readResponse(reader *bufio.Reader) (*response, error) {
 	}, nil
 }
 
+// readTrailer reads the end of message part of pow communication.
+func readTrailer(reader *bufio.Reader) error {
+	trailer := make([]byte, len(eom))
+	_, err := io.ReadFull(reader, trailer)
+	if err != nil {
+		return fmt.Errorf("readTrailer - ReadFull: %w", err)
+	}
+	if string(trailer) != eom {
+		return fmt.Errorf("readTrailer: unexpected end of message %q", trailer)
+	}
+	return nil
+}
+
+// expired reports whether the solved challenge is already expired, according to the client clock.
+func (r *response) expired() bool {
+	t, _, err := decodeToken(r.challenge)
+	return err != nil || time.Now().After(t.expires)
+}
+
 // marshal converts the response to a byte slice.
 func (r *response) marshal() []byte {
 	parts := [][]byte{
 		r.hash,
-		i32tob(r.nonce),
+		i64tob(r.nonce),
+		r.challenge,
 		[]byte(eom),
 	}
 	return bytes.Join(
@@ -237,6 +567,43 @@ func (r *response) marshal() []byte {
 	)
 }
 
+// legacyMarshal converts the response to a byte slice in the format of version 0, without the token.
+func (r *response) legacyMarshal() []byte {
+	parts := [][]byte{
+		r.hash,
+		i64tob(r.nonce),
+		[]byte(eom),
+	}
+	return bytes.Join(
+		parts,
+		[]byte{del},
+	)
+}
+
+// parseResponse reads a response from the payload of a solution frame.
+func (pow *ProofOfWork) parseResponse(payload []byte) (*response, error) {
+	if len(payload) < 9 || len(payload) < 9+int(payload[8]) {
+		return nil, fmt.Errorf("parseResponse: truncated solution")
+	}
+	size := int(payload[8])
+	return &response{
+		challenge: payload[9+size:],
+		hash:      payload[9 : 9+size],
+		nonce:     binary.BigEndian.Uint64(payload),
+		pow:       pow,
+	}, nil
+}
+
+// payload returns the response as the payload of a solution frame:
+// nonce uint64, hash length uint8, hash and the solved token.
+func (r *response) payload() []byte {
+	b := make([]byte, 0, 9+len(r.hash)+len(r.challenge))
+	b = binary.BigEndian.AppendUint64(b, r.nonce)
+	b = append(b, uint8(len(r.hash)))
+	b = append(b, r.hash...)
+	return append(b, r.challenge...)
+}
+
 // IsError function takes an error (err) as input and checks if it is an instance of the PowError type.
 // If err is an instance of PowError, it returns true; otherwise, it returns false.
 func (pow *ProofOfWork) IsError(err error) bool {
@@ -245,66 +612,177 @@ func (pow *ProofOfWork) IsError(err error) bool {
 }
 
 // IncreaseComplexity function increases the complexity of the proof of work. It locks access to the target value (pow.targetLock.Lock()),
-// increments the pow.targetBits value, and then creates a new target value target using the big package for working with big integers.
+// increases the pow.difficulty value by the step, and then creates a new target value target using the big package for working with big integers.
 func (pow *ProofOfWork) IncreaseComplexity() {
-	pow.targetLock.Lock()
-	pow.targetBits++
-	target := big.NewInt(1)
-	target.Lsh(target, hashBitLen-uint(pow.targetBits))
-	pow.targetLock.Unlock()
+	pow.SetDifficulty(pow.Difficulty() + pow.step)
 }
 
 // DecreaseComplexity function decreases the complexity of the proof of work. It locks access to the target value (pow.targetLock.Lock()),
-// decrements the pow.targetBits value, and then creates a new target value target using the big package for working with big integers.
+// decreases the pow.difficulty value by the step, and then creates a new target value target using the big package for working with big integers.
 func (pow *ProofOfWork) DecreaseComplexity() {
+	pow.SetDifficulty(pow.Difficulty() - pow.step)
+}
+
+// DifficultyStep returns the difficulty in bits IncreaseComplexity and DecreaseComplexity change it by.
+func (pow *ProofOfWork) DifficultyStep() float64 {
+	return pow.step
+}
+
+// SetDifficulty sets the difficulty in bits, clamped between 0 and 255 bits.
+func (pow *ProofOfWork) SetDifficulty(bits float64) {
+	bits = clampDifficulty(bits)
+	target := targetFromDifficulty(bits)
 	pow.targetLock.Lock()
-	pow.targetBits--
-	target := big.NewInt(1)
-	target.Lsh(target, hashBitLen-uint(pow.targetBits))
+	pow.difficulty, pow.target = bits, target
 	pow.targetLock.Unlock()
+	pow.metrics.DifficultyChanged(bits)
 }
 
-// GetComplexity function returns the current complexity level as an integer value. It simply returns the value of pow.targetBits.
+// Difficulty returns the current difficulty in bits, log2 of the expected number of hashes to solve a challenge.
+func (pow *ProofOfWork) Difficulty() float64 {
+	pow.targetLock.RLock()
+	defer pow.targetLock.RUnlock()
+	return pow.difficulty
+}
+
+// Algorithm returns the hash function the puzzle is built on.
+func (pow *ProofOfWork) Algorithm() Algorithm {
+	return pow.alg
+}
+
+// ReadTimeout returns the time the server waits for a response to the challenge. Zero means no timeout.
+func (pow *ProofOfWork) ReadTimeout() time.Duration {
+	return time.Duration(pow.readTimeout.Load())
+}
+
+// SetReadTimeout sets the time the server waits for a response to the challenges issued afterwards.
+// Zero means no timeout. Clients are told the timeout by the handshake, so the ones already connected
+// are not aware of the change.
+func (pow *ProofOfWork) SetReadTimeout(timeout time.Duration) {
+	pow.readTimeout.Store(int64(timeout))
+}
+
+// GetComplexity function returns the current complexity level as an integer value. It returns the difficulty
+// rounded up to whole bits under the read lock, which is the number of leading zeros required by clients of versions
+// not knowing arbitrary targets.
 func (pow *ProofOfWork) GetComplexity() int {
-	return int(pow.targetBits)
+	pow.targetLock.RLock()
+	defer pow.targetLock.RUnlock()
+	return int(bitsOf(pow.target))
 }
 
 // computeHash calculates the hash value for the given data and nonce.
-func (pow *ProofOfWork) computeHash(data []byte, nonce uint32) []byte {
-	checksum := sha256.Sum256(bytes.Join(
+func (pow *ProofOfWork) computeHash(data []byte, nonce uint64) []byte {
+	return computeHash(pow.alg, data, nonce)
+}
+
+// computeHash calculates the hash value for the given data and nonce with the hash function.
+func computeHash(alg Algorithm, data []byte, nonce uint64) []byte {
+	return alg.Hash(bytes.Join(
 		[][]byte{
-			i32tob(nonce),
+			i64tob(nonce),
 			data,
 		},
 		[]byte{},
 	))
-	return checksum[:]
 }
 
 // validate checks if the response hash is less than the target value.
 func (pow *ProofOfWork) validate(r *response) bool {
-	var hashInt big.Int
-	hashInt.SetBytes(r.hash)
-	return hashInt.Cmp(pow.target) == -1
+	pow.targetLock.RLock()
+	defer pow.targetLock.RUnlock()
+	return meetsTarget(r.hash, pow.target)
 }
 
-// compare checks if the newly computed hash is equal to the response hash.
-func (pow *ProofOfWork) compare(c *challenge, r *response) bool {
-	newHash := pow.computeHash(c.data, r.nonce)
+// compare checks if the newly computed hash of the solved challenge is equal to the response hash.
+func (pow *ProofOfWork) compare(r *response) bool {
+	newHash := pow.computeHash(r.challenge, r.nonce)
 	return bytes.Equal(newHash, r.hash)
 }
 
-// i32tob converts a uint32 value to a byte slice in hex format.
-func i32tob(val uint32) []byte {
-	hex := fmt.Sprintf("%x", val)
-	return []byte(hex)
+// challengeTarget returns the target of the challenge, which is the one announced with it or the one its token
+// was issued with, so a client solves the challenge of the complexity the server chose for it. The current target
+// is returned if neither is known.
+func (pow *ProofOfWork) challengeTarget(chal *challenge) *big.Int {
+	if chal.alg != nil {
+		return chal.target
+	}
+	if t, _, err := decodeToken(chal.data); err == nil {
+		return t.target
+	}
+	pow.targetLock.RLock()
+	defer pow.targetLock.RUnlock()
+	return pow.target
+}
+
+// challengeAlgorithm returns the hash function of the challenge, which is the one announced with it
+// or the one of pow.
+func (pow *ProofOfWork) challengeAlgorithm(chal *challenge) Algorithm {
+	if chal.alg != nil {
+		return chal.alg
+	}
+	return pow.alg
+}
+
+// meetsTarget checks if the hash is less than the target value.
+func meetsTarget(hash []byte, target *big.Int) bool {
+	var hashInt big.Int
+	hashInt.SetBytes(hash)
+	return hashInt.Cmp(target) == -1
+}
+
+// targetFromBits creates the target requiring targetBits leading zeros in the hash.
+func targetFromBits(targetBits uint8) *big.Int {
+	target := big.NewInt(1)
+	return target.Lsh(target, hashBitLen-uint(targetBits))
+}
+
+// targetFromDifficulty creates the target of the difficulty in bits, which is 2^(256-bits).
+// The fraction of the bits scales the target of the whole ones by 2^-fraction.
+func targetFromDifficulty(bits float64) *big.Int {
+	whole, fraction := math.Modf(bits)
+	f := new(big.Float).SetPrec(hashBitLen).SetMantExp(big.NewFloat(math.Exp2(-fraction)), hashBitLen-int(whole))
+	target, _ := f.Int(nil)
+	return target
+}
+
+// bitsOf returns the difficulty of the target rounded up to whole bits, so the target of the bits is no greater
+// than the target and every hash meeting it meets the target too.
+func bitsOf(target *big.Int) uint8 {
+	return uint8(hashBitLen + 1 - target.BitLen())
+}
+
+// clampDifficulty rounds the difficulty to difficultyPrecision and keeps it between 0 and maxDifficulty.
+func clampDifficulty(bits float64) float64 {
+	bits = math.Round(bits*difficultyPrecision) / difficultyPrecision
+	return math.Max(0, math.Min(bits, maxDifficulty))
+}
+
+// marshalTarget encodes the target as the largest acceptable hash, which fits targetLen bytes even for
+// the target of zero difficulty.
+func marshalTarget(target *big.Int) []byte {
+	return new(big.Int).Sub(target, big.NewInt(1)).FillBytes(make([]byte, targetLen))
+}
+
+// parseTarget decodes the target encoded by marshalTarget.
+func parseTarget(b []byte) (*big.Int, error) {
+	if len(b) != targetLen {
+		return nil, fmt.Errorf("parseTarget: invalid target length %d", len(b))
+	}
+	target := new(big.Int).SetBytes(b)
+	return target.Add(target, big.NewInt(1)), nil
+}
+
+// i64tob converts a uint64 value to a byte slice in hex format.
+func i64tob(val uint64) []byte {
+	return strconv.AppendUint(nil, val, 16)
 }
 
-// btoi32 converts a byte slice in hex format to a uint32 value.
-func btoi32(hex []byte) (uint32, error) {
-	val, err := strconv.ParseUint(string(hex), 16, 32)
+// btoi64 converts a byte slice in hex format to a uint64 value.
+func btoi64(hex []byte) (uint64, error) {
+	val, err := strconv.ParseUint(string(hex), 16, 64)
 	if err != nil {
-		return 0, fmt.Errorf("btoi32 - ParseUint: %v", err)
+		return 0, fmt.Errorf("btoi64 - ParseUint: %v", err)
 	}
-	return uint32(val), nil
+	return val, nil
 }
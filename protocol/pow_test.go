@@ -2,10 +2,13 @@ package protocol
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"math"
+	"math/big"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -17,7 +20,7 @@ func testSolver(t *testing.T, pow *ProofOfWork, address string) {
 	chal, err := pow.readChallenge(bufio.NewReader(conn))
 	require.NoError(t, err)
 
-	resp := pow.newResponse(nil, 0)
+	resp := pow.newResponse(chal.data, nil, 0)
 	for resp.nonce < math.MaxInt32 {
 		resp.hash = pow.computeHash(chal.data, resp.nonce)
 		if pow.validate(resp) {
@@ -275,3 +278,95 @@ func TestSolveChallenge(t *testing.T) {
 	err = pow.ChallengeResponse(conn, data)
 	require.NoError(t, err)
 }
+
+func TestProofOfWork_Nonce64(t *testing.T) {
+	data := []byte("127.0.0.1")
+	pow := NewProofOfWork(8, time.Second*10)
+
+	chal, err := pow.newChallenge(data)
+	require.NoError(t, err)
+
+	// Nonces above 32 bits are accepted by the server
+	resp, err := pow.search(context.Background(), chal, math.MaxUint32+1, math.MaxUint64, new(atomic.Uint64))
+	require.NoError(t, err)
+	require.Greater(t, resp.nonce, uint64(math.MaxUint32))
+
+	server, client := net.Pipe()
+	go func() {
+		_, _ = pow.readChallenge(bufio.NewReader(client))
+		_, _ = client.Write(resp.marshal())
+	}()
+	require.NoError(t, pow.ChallengeResponse(server, data))
+
+	nonce, err := btoi64(i64tob(math.MaxUint64))
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint64), nonce)
+}
+
+func TestProofOfWork_Unsolvable(t *testing.T) {
+	pow := NewProofOfWork(hashBitLen-1, 0)
+
+	chal, err := pow.newChallenge([]byte("127.0.0.1"))
+	require.NoError(t, err)
+
+	_, err = pow.search(context.Background(), chal, math.MaxUint64-100, math.MaxUint64, new(atomic.Uint64))
+	require.ErrorIs(t, err, ErrUnsolvable)
+}
+
+func TestProofOfWork_Difficulty(t *testing.T) {
+	require.Zero(t, targetFromBits(20).Cmp(targetFromDifficulty(20)))
+	require.Zero(t, targetFromBits(0).Cmp(targetFromDifficulty(0)))
+
+	// Fractional bits give targets between the ones of whole bits
+	target := targetFromDifficulty(19.5)
+	require.Equal(t, -1, targetFromBits(20).Cmp(target))
+	require.Equal(t, 1, targetFromBits(19).Cmp(target))
+	require.Equal(t, uint8(20), bitsOf(target))
+	require.InEpsilon(t, math.Exp2(19.5), NewProofOfWork(0, 0).expectedHashes(&challenge{target: target, alg: sha256Algorithm{}}), 1e-9)
+
+	for _, target := range []*big.Int{targetFromBits(0), target, big.NewInt(1)} {
+		parsed, err := parseTarget(marshalTarget(target))
+		require.NoError(t, err)
+		require.Zero(t, target.Cmp(parsed))
+	}
+
+	pow := NewProofOfWork(8, 0, WithDifficulty(6.5), WithDifficultyStep(0.25))
+	require.Equal(t, 6.5, pow.Difficulty())
+	require.Equal(t, 7, pow.GetComplexity())
+	pow.IncreaseComplexity()
+	require.Equal(t, 6.75, pow.Difficulty())
+	pow.SetDifficulty(-1)
+	require.Zero(t, pow.Difficulty())
+	pow.SetDifficulty(1000)
+	require.Equal(t, float64(maxDifficulty), pow.Difficulty())
+}
+
+func TestServer_FractionalDifficulty(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(0, time.Second*10, WithDifficulty(6.5))
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	// Clients not knowing arbitrary targets solve challenges of the difficulty rounded up
+	for _, legacy := range []bool{false, true} {
+		var opts []ClientOption
+		if legacy {
+			opts = append(opts, WithLegacyHandshake())
+		}
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		c, err := NewClient(conn, opts...)
+		require.NoError(t, err)
+		require.Equal(t, uint8(7), c.Session().Complexity)
+
+		quote, err := c.GetQuote()
+		require.NoError(t, err)
+		require.Equal(t, "Test quote", quote)
+	}
+}
@@ -0,0 +1,90 @@
+package protocol
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// defaultReplayCacheSize - default number of accepted solutions remembered by the server.
+const defaultReplayCacheSize = 1 << 16
+
+// replayEntry represents an accepted solution remembered by the replay cache.
+type replayEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+// replayCache remembers accepted (challenge, nonce) pairs until their challenges expire, so a solution cannot be redeemed twice.
+// Entries are kept in the order of insertion: expired ones are dropped from the front, and when the cache is full
+// of valid ones the oldest is dropped to keep the memory bounded. The cache then refuses every solution whose
+// challenge expires no later than the dropped one, as it cannot tell whether the solution has been accepted.
+type replayCache struct {
+	// maxSize - maximum number of remembered solutions
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List
+	// forgotten - the latest expiry of the valid solutions dropped because the cache was full
+	forgotten time.Time
+}
+
+// newReplayCache creates a new replay cache remembering at most maxSize solutions.
+func newReplayCache(maxSize int) *replayCache {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &replayCache{
+		maxSize: maxSize,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// replayKey returns the key of the solution in the replay cache.
+func replayKey(r *response) [sha256.Size]byte {
+	return sha256.Sum256(append(append([]byte{}, r.challenge...), i64tob(r.nonce)...))
+}
+
+// add remembers the solution until expires. It returns ErrChallengeReplayed if the solution has already been
+// remembered, and ErrChallengeExpired if it might have been remembered and dropped since because the cache was full.
+func (c *replayCache) add(key [sha256.Size]byte, expires, now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for front := c.order.Front(); front != nil && !front.Value.(*replayEntry).expires.After(now); front = c.order.Front() {
+		c.remove(front)
+	}
+
+	if _, ok := c.entries[key]; ok {
+		return ErrChallengeReplayed
+	}
+	if !expires.After(c.forgotten) {
+		return ErrChallengeExpired
+	}
+
+	if c.order.Len() >= c.maxSize {
+		front := c.order.Front()
+		if e := front.Value.(*replayEntry).expires; e.After(c.forgotten) {
+			c.forgotten = e
+		}
+		c.remove(front)
+	}
+	c.entries[key] = c.order.PushBack(&replayEntry{key: key, expires: expires})
+	return nil
+}
+
+// len returns the number of remembered solutions.
+func (c *replayCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// remove forgets the solution.
+func (c *replayCache) remove(e *list.Element) {
+	delete(c.entries, e.Value.(*replayEntry).key)
+	c.order.Remove(e)
+}
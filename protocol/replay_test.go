@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayCache_Add(t *testing.T) {
+	cache := newReplayCache(3)
+	now := time.Now()
+	key := func(i byte) [sha256.Size]byte { return [sha256.Size]byte{i} }
+
+	require.NoError(t, cache.add(key(1), now.Add(time.Minute), now))
+	require.ErrorIs(t, cache.add(key(1), now.Add(time.Minute), now), ErrChallengeReplayed)
+	require.NoError(t, cache.add(key(2), now.Add(time.Second), now))
+	require.NoError(t, cache.add(key(3), now.Add(2*time.Minute), now))
+
+	// The cache is full, the oldest solution is forgotten and cannot be replayed, nor can the solutions
+	// of the challenges expiring before it
+	require.NoError(t, cache.add(key(4), now.Add(2*time.Minute), now))
+	require.Equal(t, 3, cache.len())
+	require.ErrorIs(t, cache.add(key(1), now.Add(time.Minute), now), ErrChallengeExpired)
+	require.ErrorIs(t, cache.add(key(5), now.Add(time.Second), now), ErrChallengeExpired)
+	require.Equal(t, 3, cache.len())
+
+	// Expired solutions are forgotten
+	later := now.Add(2 * time.Second)
+	require.NoError(t, cache.add(key(5), later.Add(time.Minute), later))
+	require.Equal(t, 3, cache.len())
+	require.ErrorIs(t, cache.add(key(4), now.Add(2*time.Minute), later), ErrChallengeReplayed)
+}
+
+func TestProofOfWork_Replay(t *testing.T) {
+	data := []byte("127.0.0.1")
+	pow := NewProofOfWork(8, time.Second*10)
+
+	chal, err := pow.newChallenge(data)
+	require.NoError(t, err)
+	resp, err := pow.solve(chal)
+	require.NoError(t, err)
+
+	require.NoError(t, pow.verify(data, resp))
+	require.ErrorIs(t, pow.verify(data, resp), ErrChallengeReplayed)
+	require.True(t, pow.IsError(ErrChallengeReplayed))
+
+	// Replay on another connection
+	server, client := net.Pipe()
+	go func() {
+		reader := bufio.NewReader(client)
+		_, _ = pow.readChallenge(reader)
+		_, _ = client.Write(resp.marshal())
+	}()
+	require.ErrorIs(t, pow.ChallengeResponse(server, data), ErrChallengeReplayed)
+}
+
+func TestProofOfWork_ReplayFullCache(t *testing.T) {
+	data := []byte("127.0.0.1")
+	pow := NewProofOfWork(4, time.Second*10, WithReplayCacheSize(4))
+
+	solve := func() *response {
+		// Challenges issued in the same millisecond expire at the same time
+		time.Sleep(time.Millisecond)
+		chal, err := pow.newChallenge(data)
+		require.NoError(t, err)
+		resp, err := pow.solve(chal)
+		require.NoError(t, err)
+		return resp
+	}
+	first := solve()
+	require.NoError(t, pow.verify(data, first))
+
+	// The solutions accepted afterwards fill the cache and push the first one out of it
+	for i := 0; i < 4; i++ {
+		require.NoError(t, pow.verify(data, solve()))
+	}
+	require.Equal(t, 4, pow.replay.len())
+	require.ErrorIs(t, pow.verify(data, first), ErrChallengeExpired)
+
+	// New challenges are still accepted
+	require.NoError(t, pow.verify(data, solve()))
+}
+
+func TestProofOfWork_Expired(t *testing.T) {
+	data := []byte("127.0.0.1")
+	pow := NewProofOfWork(8, time.Second*10, WithChallengeTTL(time.Millisecond))
+
+	chal, err := pow.newChallenge(data)
+	require.NoError(t, err)
+	resp, err := pow.solve(chal)
+	require.NoError(t, err)
+	time.Sleep(2 * time.Millisecond)
+
+	require.ErrorIs(t, pow.verify(data, resp), ErrChallengeExpired)
+	require.True(t, pow.IsError(ErrChallengeExpired))
+}
@@ -0,0 +1,240 @@
+package protocol
+
+import (
+	"container/list"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxClientIDLen - the maximum length of the client ID sent in HELLO
+	maxClientIDLen = 64
+	// defaultHalfLife - the time it takes a score to halve unless configured otherwise
+	defaultHalfLife = time.Minute
+	// defaultMaxExtraBits - the most bits the reputation may add to the complexity unless configured otherwise
+	defaultMaxExtraBits = 8
+	// defaultMaxClients - the maximum number of clients with a reputation unless configured otherwise
+	defaultMaxClients = 65536
+	// defaultMaxIDsPerSubnet - the maximum number of client IDs with a reputation per subnet unless configured otherwise
+	defaultMaxIDsPerSubnet = 64
+)
+
+// ReputationConfig represents the configuration of the reputation tracker. The score of a client grows by
+// the penalty of every event and halves every HalfLife, the complexity of its challenges is raised by one bit
+// per point of the score, which doubles the work to solve them.
+type ReputationConfig struct {
+	// FailurePenalty - score added when the client fails a challenge
+	FailurePenalty float64
+	// TimeoutPenalty - score added when the client does not answer a challenge in time
+	TimeoutPenalty float64
+	// RequestPenalty - score added for every challenge issued to the client and every request served with
+	// an access token, so a client hammering the server gets a higher complexity even if it solves every challenge
+	RequestPenalty float64
+	// HalfLife - the time it takes a score to halve, a minute if zero
+	HalfLife time.Duration
+	// MaxExtraBits - the most bits the reputation may add to the complexity, 8 if zero
+	MaxExtraBits uint8
+	// SubnetWeight - the weight of the score of the subnet for clients sending an ID. Client IDs are not
+	// authenticated, so clients behind a shared address are told apart by them, while changing the ID
+	// does not clear the whole score of the subnet
+	SubnetWeight float64
+	// IPv4Prefix - length of the prefix of the IPv4 subnets tracked as a single client, 32 if zero
+	IPv4Prefix int
+	// IPv6Prefix - length of the prefix of the IPv6 subnets tracked as a single client, 64 if zero
+	IPv6Prefix int
+	// MaxClients - the maximum number of clients with a reputation, 65536 if zero. Clients whose score has
+	// decayed below a bit are forgotten, new ones are not tracked while the least recently penalized one
+	// is still penalized
+	MaxClients int
+	// MaxIDsPerSubnet - the maximum number of client IDs with a reputation per subnet, 64 if zero. Client IDs
+	// are chosen by the clients, so once a subnet has sent that many, its other clients get the whole score
+	// of the subnet instead of filling the table with made-up IDs
+	MaxIDsPerSubnet int
+}
+
+// reputationEvent is a behaviour of a client affecting its reputation.
+type reputationEvent int
+
+const (
+	// eventRequest - a challenge is issued to the client, or its request is served with an access token
+	eventRequest reputationEvent = iota
+	// eventFailure - the client failed a challenge
+	eventFailure
+	// eventTimeout - the client did not answer a challenge in time
+	eventTimeout
+)
+
+// score of a client decaying over time.
+type score struct {
+	// key - the subnet, or the subnet and the client ID separated by a slash
+	key string
+	// subnet of the client ID, empty for the score of a subnet
+	subnet  string
+	value   float64
+	updated time.Time
+}
+
+// at returns the value of the score decayed until now.
+func (s *score) at(now time.Time, halfLife time.Duration) float64 {
+	return s.value * math.Exp2(-float64(now.Sub(s.updated))/float64(halfLife))
+}
+
+// Reputation tracks the behaviour of clients by subnet and client ID and raises the complexity
+// of the challenges of those failing them, timing out or hammering the server.
+type Reputation struct {
+	// Reputation configuration
+	cfg ReputationConfig
+	// now returns the current time, replaced by tests
+	now func() time.Time
+
+	// mu guards scores, order and ids
+	mu sync.Mutex
+	// scores - scores of the subnets and the clients sending an ID
+	scores map[string]*list.Element
+	// order - the scores by the time they were last penalized, the least recently penalized first
+	order *list.List
+	// ids - number of client IDs with a score by subnet
+	ids map[string]int
+}
+
+// NewReputation creates a new reputation tracker.
+func NewReputation(cfg ReputationConfig) *Reputation {
+	if cfg.HalfLife == 0 {
+		cfg.HalfLife = defaultHalfLife
+	}
+	if cfg.MaxExtraBits == 0 {
+		cfg.MaxExtraBits = defaultMaxExtraBits
+	}
+	if cfg.IPv4Prefix == 0 {
+		cfg.IPv4Prefix = defaultIPv4Prefix
+	}
+	if cfg.IPv6Prefix == 0 {
+		cfg.IPv6Prefix = defaultIPv6Prefix
+	}
+	if cfg.MaxClients == 0 {
+		cfg.MaxClients = defaultMaxClients
+	}
+	if cfg.MaxIDsPerSubnet == 0 {
+		cfg.MaxIDsPerSubnet = defaultMaxIDsPerSubnet
+	}
+	return &Reputation{
+		cfg: cfg, now: time.Now, scores: make(map[string]*list.Element), order: list.New(), ids: make(map[string]int),
+	}
+}
+
+// WithReputation enables the reputation tracker.
+func WithReputation(reputation *Reputation) ServerOption {
+	return func(s *Server) {
+		s.reputation = reputation
+	}
+}
+
+// clientKey identifies a client with a reputation.
+type clientKey struct {
+	// subnet the client connects from
+	subnet string
+	// id - the client ID sent in HELLO, empty if none
+	id string
+}
+
+// key returns the key of the client connecting from the address with the ID.
+func (r *Reputation) key(addr net.Addr, id string) clientKey {
+	return clientKey{subnet: subnet(addr, r.cfg.IPv4Prefix, r.cfg.IPv6Prefix), id: id}
+}
+
+// ExtraBits returns the number of bits the reputation of the client adds to the complexity.
+func (r *Reputation) ExtraBits(addr net.Addr, id string) uint8 {
+	return r.extraBits(r.key(addr, id))
+}
+
+// extraBits returns the number of bits the reputation of the client adds to the complexity.
+func (r *Reputation) extraBits(k clientKey) uint8 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	value := r.value(k.subnet, now)
+	if k.id != "" {
+		key := k.subnet + "/" + k.id
+		if _, ok := r.scores[key]; ok || r.ids[k.subnet] < r.cfg.MaxIDsPerSubnet {
+			value = math.Max(r.value(key, now), r.cfg.SubnetWeight*value)
+		}
+	}
+	if value >= float64(r.cfg.MaxExtraBits) {
+		return r.cfg.MaxExtraBits
+	}
+	return uint8(value)
+}
+
+// record adds the penalty of the event to the score of the client and of its subnet.
+func (r *Reputation) record(k clientKey, event reputationEvent) {
+	var penalty float64
+	switch event {
+	case eventRequest:
+		penalty = r.cfg.RequestPenalty
+	case eventFailure:
+		penalty = r.cfg.FailurePenalty
+	case eventTimeout:
+		penalty = r.cfg.TimeoutPenalty
+	}
+	if penalty <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	r.add(k.subnet, "", penalty, now)
+	if k.id != "" && (r.scores[k.subnet+"/"+k.id] != nil || r.ids[k.subnet] < r.cfg.MaxIDsPerSubnet) {
+		r.add(k.subnet+"/"+k.id, k.subnet, penalty, now)
+	}
+}
+
+// value returns the decayed score of the key.
+func (r *Reputation) value(key string, now time.Time) float64 {
+	e, ok := r.scores[key]
+	if !ok {
+		return 0
+	}
+	return e.Value.(*score).at(now, r.cfg.HalfLife)
+}
+
+// add adds the penalty to the decayed score of the key, the score of a client ID of the subnet unless it is empty.
+func (r *Reputation) add(key, subnet string, penalty float64, now time.Time) {
+	e, ok := r.scores[key]
+	if !ok {
+		if r.order.Len() >= r.cfg.MaxClients && !r.evict(now) {
+			return
+		}
+		e = r.order.PushBack(&score{key: key, subnet: subnet})
+		r.scores[key] = e
+		if subnet != "" {
+			r.ids[subnet]++
+		}
+	}
+	s := e.Value.(*score)
+	s.value = s.at(now, r.cfg.HalfLife) + penalty
+	s.updated = now
+	r.order.MoveToBack(e)
+}
+
+// evict forgets the least recently penalized scores as long as they have decayed below a bit and reports
+// whether any was forgotten. Every score is forgotten once, so the cost is amortized over the penalties.
+func (r *Reputation) evict(now time.Time) bool {
+	evicted := false
+	for front := r.order.Front(); front != nil && front.Value.(*score).at(now, r.cfg.HalfLife) < 1; front = r.order.Front() {
+		s := front.Value.(*score)
+		delete(r.scores, s.key)
+		r.order.Remove(front)
+		if s.subnet != "" {
+			r.ids[s.subnet]--
+			if r.ids[s.subnet] == 0 {
+				delete(r.ids, s.subnet)
+			}
+		}
+		evicted = true
+	}
+	return evicted
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReputation(t *testing.T) {
+	now := time.Now()
+	reputation := NewReputation(ReputationConfig{
+		FailurePenalty: 2,
+		TimeoutPenalty: 1,
+		HalfLife:       time.Minute,
+		MaxExtraBits:   5,
+		SubnetWeight:   0.5,
+	})
+	reputation.now = func() time.Time { return now }
+
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.1.17"), Port: 4000}
+	client := reputation.key(addr, "")
+	reputation.record(client, eventRequest)
+	require.Zero(t, reputation.ExtraBits(addr, ""))
+
+	reputation.record(client, eventFailure)
+	reputation.record(client, eventTimeout)
+	require.Equal(t, uint8(3), reputation.ExtraBits(addr, ""))
+
+	// The score halves every half-life
+	now = now.Add(time.Minute)
+	require.Equal(t, uint8(1), reputation.ExtraBits(addr, ""))
+
+	reputation.record(client, eventFailure)
+	reputation.record(client, eventFailure)
+	reputation.record(client, eventFailure)
+	require.Equal(t, uint8(5), reputation.ExtraBits(addr, ""))
+
+	// A client sending an ID gets its own score and the weighted score of its subnet
+	require.Equal(t, uint8(3), reputation.ExtraBits(addr, "well-behaved"))
+	reputation.record(reputation.key(addr, "misbehaving"), eventFailure)
+	require.Equal(t, uint8(4), reputation.ExtraBits(addr, "misbehaving"))
+}
+
+func TestReputation_MaxClients(t *testing.T) {
+	now := time.Now()
+	reputation := NewReputation(ReputationConfig{FailurePenalty: 4, HalfLife: time.Minute, MaxClients: 3})
+	reputation.now = func() time.Time { return now }
+	addr := func(i byte) net.Addr { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, i)} }
+
+	reputation.record(reputation.key(addr(1), ""), eventFailure)
+	now = now.Add(time.Minute)
+	reputation.record(reputation.key(addr(2), ""), eventFailure)
+	reputation.record(reputation.key(addr(3), ""), eventFailure)
+	now = now.Add(time.Second)
+
+	// The table is full of penalized clients, a new one is not tracked
+	reputation.record(reputation.key(addr(4), ""), eventFailure)
+	require.Zero(t, reputation.ExtraBits(addr(4), ""))
+	require.Len(t, reputation.scores, 3)
+
+	// The least recently penalized client is forgotten once its score decays below a bit
+	now = now.Add(time.Minute)
+	reputation.record(reputation.key(addr(4), ""), eventFailure)
+	require.Equal(t, uint8(4), reputation.ExtraBits(addr(4), ""))
+	require.Zero(t, reputation.ExtraBits(addr(1), ""))
+	require.Equal(t, uint8(1), reputation.ExtraBits(addr(2), ""))
+	require.Equal(t, reputation.order.Len(), len(reputation.scores))
+	require.Equal(t, reputation.key(addr(4), "").subnet, reputation.order.Back().Value.(*score).key)
+}
+
+func TestReputation_MaxIDsPerSubnet(t *testing.T) {
+	reputation := NewReputation(ReputationConfig{FailurePenalty: 1.5, HalfLife: time.Hour, MaxIDsPerSubnet: 2, SubnetWeight: 0.25})
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.1.17")}
+
+	// The IDs of the subnet beyond the limit are not tracked and get the whole score of the subnet
+	for _, id := range []string{"a", "b", "c", "d"} {
+		reputation.record(reputation.key(addr, id), eventFailure)
+	}
+	require.Len(t, reputation.scores, 3)
+	require.Equal(t, 2, reputation.ids[reputation.key(addr, "").subnet])
+	require.Equal(t, uint8(5), reputation.ExtraBits(addr, ""))
+	require.Equal(t, uint8(1), reputation.ExtraBits(addr, "a"))
+	require.Equal(t, uint8(5), reputation.ExtraBits(addr, "c"))
+	require.Equal(t, uint8(5), reputation.ExtraBits(addr, "made-up"))
+
+	// The other subnets are not affected
+	require.Zero(t, reputation.ExtraBits(&net.TCPAddr{IP: net.ParseIP("192.168.2.17")}, "e"))
+}
+
+func TestServer_Reputation(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(4, time.Second*10, WithSecret([]byte("secret")))
+	reputation := NewReputation(ReputationConfig{FailurePenalty: 2.5})
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	}, WithReputation(reputation))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn, WithClientID("misbehaving"))
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), c.Session().Complexity)
+
+	// A solution of a challenge signed by another server fails
+	stranger := NewProofOfWork(4, 0, WithSecret([]byte("another secret")))
+	chal, err := stranger.newChallenge([]byte("127.0.0.1"))
+	require.NoError(t, err)
+	c.solution, err = stranger.solve(chal)
+	require.NoError(t, err)
+	_, err = c.GetQuote()
+	require.ErrorIs(t, err, ErrInvalidSolution)
+
+	// The failing client gets harder challenges, which it solves, the other ones do not
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, c.Reconnect(conn))
+	require.Equal(t, uint8(6), c.Session().Complexity)
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	other, err := NewClient(conn, WithClientID("well-behaved"))
+	require.NoError(t, err)
+	require.Equal(t, uint8(4), other.Session().Complexity)
+}
@@ -3,21 +3,40 @@ package protocol
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+// errorWriteTimeout - the time to send the error frame to the client before the connection is closed.
+const errorWriteTimeout = time.Second
+
 type serverChallengeResponse interface {
-	ChallengeResponse(conn net.Conn, data []byte) error // Method for generating a challenge response
-	IncreaseComplexity()                                // Method to increase the complexity of the protocol
-	DecreaseComplexity()                                // Method to decrease the complexity of the protocol
-	GetComplexity() int                                 // Method to get the current complexity level of the protocol
-	IsError(error) bool                                 // Method to check if an error is of type 'PowError'
+	ChallengeResponseContext(ctx context.Context, conn net.Conn, data []byte) error                           // Method for generating a challenge response
+	challengeResponse(ctx context.Context, conn net.Conn, data []byte, difficulty float64, legacy bool) error // Method for generating a challenge response of the difficulty
+	IncreaseComplexity()                                                                                      // Method to increase the complexity of the protocol
+	DecreaseComplexity()                                                                                      // Method to decrease the complexity of the protocol
+	GetComplexity() int                                                                                       // Method to get the current complexity level of the protocol
+	Difficulty() float64                                                                                      // Method to get the current difficulty of the protocol in bits
+	Algorithm() Algorithm                                                                                     // Method to get the hash function of the protocol
+	ReadTimeout() time.Duration                                                                               // Method to get the timeout for the response
+	issueChallenge(data []byte, difficulty float64) (*challenge, error)                                       // Method for issuing a challenge of the difficulty bound to the client data
+	parseResponse(payload []byte) (*response, error)                                                          // Method for reading a response from a solution frame
+	verify(data []byte, r *response) error                                                                    // Method for verifying a response
+	key() ([]byte, error)                                                                                     // Method for getting the HMAC key challenges are signed with
+	IsError(error) bool                                                                                       // Method to check if an error is of type 'PowError'
 }
 
 // Request of the protocol
@@ -26,8 +45,9 @@ type Request string
 // Response of the protocol
 type Response string
 
-// Handler function to be executed for incoming connections
-type Handler func(*Request) (*Response, error)
+// Handler function to be executed for incoming connections. ctx is the context of the request:
+// it is canceled when the peer disconnects or the server stops serving.
+type Handler func(ctx context.Context, req *Request) (*Response, error)
 
 // Server for handling tcp connection for Quote server
 type Server struct {
@@ -39,27 +59,138 @@ type Server struct {
 	synTimeout time.Duration
 	// Handler function to be executed for incoming connections
 	handler Handler
+	// Reports whether the handler serves the command, optional, see WithCommands
+	commands func(command string) bool
+	// Adaptive difficulty controller, optional
+	controller *Controller
+	// Connection limiter, optional
+	limiter *Limiter
+	// Reputation tracker raising the complexity for misbehaving clients, optional
+	reputation *Reputation
+	// Access tokens sparing the challenges of the following requests, optional
+	access *accessTokens
+	// The maximum number of requests of a connection handled at once since MultiplexVersion
+	maxConcurrent uint16
+	// The maximum length of a request in bytes, unlimited if zero
+	maxRequestSize int
+	// Recorder of the metrics of the server
+	metrics Metrics
+	// Tracer of the connections and their requests
+	tracer trace.Tracer
+	// TLS configuration of the accepted connections, nil to accept plain TCP ones
+	tlsConfig *tls.Config
+	// Challenges of the clients authenticated by their certificates
+	certPolicy ClientCertPolicy
+	// Middlewares wrapping the handler, the first one is the outermost
+	middlewares []Middleware
+	// ID of the last accepted connection
+	lastConnID atomic.Uint64
+	// Number of accepted connections and of received requests
+	accepted atomic.Uint64
+	requests atomic.Uint64
+	// powDisabled is set while the connections handshaking are not challenged, see SetPowEnabled
+	powDisabled atomic.Bool
+
+	// inShutdown is set once Shutdown or Close is called
+	inShutdown atomic.Bool
+	// mu guards listeners and conns
+	mu sync.Mutex
+	// Listeners being served
+	listeners map[*net.Listener]struct{}
+	// Connections being served
+	conns map[*conn]struct{}
+}
+
+// ServerOption configures optional features of the server.
+type ServerOption func(*Server)
+
+// WithController enables the adaptive difficulty controller.
+// The controller runs while Serve accepts connections.
+func WithController(controller *Controller) ServerOption {
+	return func(s *Server) {
+		s.controller = controller
+	}
+}
+
+// WithMaxRequestSize limits the length of the requests to size bytes. Longer requests are refused with
+// ErrBadRequest as soon as they are read, before the client is challenged.
+func WithMaxRequestSize(size int) ServerOption {
+	return func(s *Server) {
+		s.maxRequestSize = size
+	}
 }
 
 // NewServer creates a new instance of the server.
-func NewServer(logger *zap.SugaredLogger, crProto serverChallengeResponse, synTimeout time.Duration, handler Handler) *Server {
-	return &Server{logger: logger, crProto: crProto, synTimeout: synTimeout, handler: handler}
+func NewServer(logger *zap.SugaredLogger, crProto serverChallengeResponse, synTimeout time.Duration, handler Handler, opts ...ServerOption) *Server {
+	s := &Server{logger: logger, crProto: crProto, synTimeout: synTimeout, handler: handler, maxConcurrent: defaultMaxConcurrent,
+		metrics: nopMetrics{}, tracer: trace.NewNoopTracerProvider().Tracer(tracerName)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.handler = Chain(s.handler, s.middlewares...)
+	return s
 }
 
 // newConn creates a new connection object associated with the server.
 func (s *Server) newConn(rwc net.Conn) *conn {
-	return &conn{server: s, rwc: rwc}
+	return &conn{server: s, rwc: rwc, br: bufio.NewReader(rwc), id: s.lastConnID.Add(1), since: time.Now()}
+}
+
+// reject tells the client of the connection over the limits it is rejected with the error and closes it.
+func (s *Server) reject(rw net.Conn, err error) {
+	s.logger.Debugw("protocol: connection rejected", "remote", rw.RemoteAddr().String(), "error", err)
+	if !s.limiter.acquireRejecting() {
+		_ = rw.Close()
+		return
+	}
+	go func() {
+		defer s.limiter.releaseRejecting()
+		c := s.newConn(rw)
+		c.reject(NewServerError(err))
+		c.closeQuietly()
+	}()
 }
 
 // Serve starts accepting and serving incoming connections.
+func (s *Server) Serve(l net.Listener) error {
+	return s.ServeContext(context.Background(), l)
+}
+
+// ServeContext starts accepting and serving incoming connections. ctx is the root context of every connection
+// and request: when it is done, the listener is closed, the connections are interrupted and ctx.Err() is returned.
 //
 //nolint:gomnd // const for retry needs no explanation
-func (s *Server) Serve(l net.Listener) error {
+func (s *Server) ServeContext(ctx context.Context, l net.Listener) error {
 	var tempDelay time.Duration
 
+	if !s.trackListener(&l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(&l, false)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = l.Close()
+		case <-stop:
+		}
+	}()
+
+	if s.controller != nil {
+		go s.controller.Run(stop)
+	}
+
 	for {
 		rw, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if ne, ok := err.(net.Error); ok && !ne.Timeout() {
 				// Retry accepting connections with an increasing delay in case of non-timeout error
 				if tempDelay == 0 {
@@ -76,10 +207,29 @@ func (s *Server) Serve(l net.Listener) error {
 			}
 			return err
 		}
+		if s.tlsConfig != nil {
+			rw = tls.Server(rw, s.tlsConfig)
+		}
+
+		var source string
+		if s.limiter != nil {
+			source = s.limiter.source(rw.RemoteAddr())
+			if err = s.limiter.acquireConn(source); err != nil {
+				s.reject(rw, err)
+				continue
+			}
+		}
 
 		// Handle the incoming connection in a separate goroutine
 		c := s.newConn(rw)
-		go c.serve()
+		c.source = source
+		s.trackConn(c, true)
+		s.accepted.Add(1)
+		s.metrics.ConnAccepted()
+		if s.controller != nil {
+			s.controller.connOpened()
+		}
+		go c.serve(ctx)
 	}
 }
 
@@ -88,82 +238,531 @@ type conn struct {
 	server *Server
 	// Underlying network connection associated with the connection
 	rwc net.Conn
+	// ID of the connection, unique within the server
+	id uint64
+	// The time the connection was accepted
+	since time.Time
+	// Number of requests received on the connection
+	requests atomic.Uint64
+	// Buffered reader of the requests
+	br *bufio.Reader
+	// State of the connection, see connState
+	state atomic.Int32
+	// Source subnet of the connection, set if the limiter is enabled
+	source string
+	// ID the client sent in HELLO, empty if none
+	clientID string
+	// Whether the client presented a certificate verified by the TLS handshake
+	authenticated bool
+	// Parameters negotiated by the handshake
+	session *Session
+	// Frame encoder and decoder of the connection, used since FramedVersion
+	enc *Encoder
+	dec *Decoder
+
+	// mu guards streams and handshaken
+	mu sync.Mutex
+	// Whether the handshake has completed, after which the session is not changed
+	handshaken bool
+	// Requests in flight on a connection of MultiplexVersion and later, by ID
+	streams map[uint32]*stream
 }
 
 // serve is the main function for handling a connection.
-func (c *conn) serve() {
-	syn, err := c.syn()
-	if err != nil {
-		c.close(fmt.Errorf("serve - syn: %v", err))
-		return
+// The connection is interrupted when ctx is done.
+func (c *conn) serve(ctx context.Context) {
+	defer c.server.trackConn(c, false)
+	defer c.server.metrics.ConnClosed()
+	if c.server.controller != nil {
+		defer c.server.controller.connClosed()
+	}
+	if c.server.limiter != nil {
+		defer c.server.limiter.releaseConn(c.source)
+	}
+	defer c.recoverPanic()
+
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, connIDKey{}, c.id))
+	defer cancel()
+	stop := interruptOnDone(ctx, c.rwc)
+	defer stop()
+
+	if tc, ok := c.rwc.(*tls.Conn); ok {
+		if err := c.tlsHandshake(ctx, tc); err != nil {
+			c.server.metrics.Handshake(0, err)
+			c.close(fmt.Errorf("serve - tlsHandshake: %w", err))
+			return
+		}
 	}
 
-	// Retrieve the complexity level from the challenge-response protocol, if implemented
-	var crComplexity int16
-	if c.server.crProto != serverChallengeResponse(nil) {
-		crComplexity = int16(c.server.crProto.GetComplexity())
+	_, span := c.startSpan(ctx, "wow.handshake")
+	err := c.handshake()
+	if err == nil {
+		span.SetAttributes(attrVersion.Int(int(c.session.Version)))
 	}
-	err = c.ack(syn, crComplexity)
+	endSpan(span, err)
 	if err != nil {
-		c.close(fmt.Errorf("serve - ack: %v", err))
+		c.server.metrics.Handshake(0, err)
+		c.close(fmt.Errorf("serve - handshake: %w", err))
+		return
+	}
+	c.server.metrics.Handshake(c.session.Version, nil)
+	c.mu.Lock()
+	c.handshaken = true
+	c.mu.Unlock()
+	if c.framed() {
+		c.enc = NewEncoder(c.rwc, c.session.MaxFrameSize, contains(c.session.Compression, compressionFlate))
+		c.dec = NewDecoder(c.br, c.session.MaxFrameSize)
+	}
+	if c.multiplexed() {
+		c.enc.EnableRequestIDs()
+		c.dec.EnableRequestIDs()
+		c.serveMultiplexed(ctx)
 		return
 	}
 
 	for {
+		// The connection is closed while it waits for a request once the server is shutting down
+		if !c.state.CompareAndSwap(int32(stateActive), int32(stateIdle)) {
+			// Closed by the server meanwhile
+			_ = c.rwc.Close()
+			return
+		}
+		if ctx.Err() != nil || c.server.shuttingDown() {
+			_ = c.rwc.Close()
+			return
+		}
+
 		// Receive a message from the client
-		req, err := bufio.NewReader(c.rwc).ReadSlice('\n')
+		req, token, err := c.readRequest()
 		if err != nil {
-			if err == io.EOF {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil || c.server.shuttingDown() {
+				_ = c.rwc.Close()
 				return
 			}
-			c.close(fmt.Errorf("serve - ReadSlice: %v", err))
+			c.sendError(err)
+			c.close(fmt.Errorf("serve - readRequest: %w", err))
+			return
+		}
+		if !c.state.CompareAndSwap(int32(stateIdle), int32(stateActive)) {
+			// Closed by the server meanwhile
+			return
+		}
+
+		if !c.serveRequest(ctx, &stream{conn: c}, req, token) {
 			return
 		}
+	}
+}
+
+// serveRequest performs the challenge-response, unless the request carries a valid access token,
+// and calls the handler of the server for the request. It returns false if the connection has been closed.
+// On a multiplexed connection the failures end only the request.
+func (c *conn) serveRequest(ctx context.Context, s *stream, req Request, token []byte) bool {
+	ctx, span := c.startSpan(ctx, "wow.request", attrCommand.String(req.Command()), attrRequestID.Int64(int64(s.id)))
+	defer span.End()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	c.requests.Add(1)
+	c.server.requests.Add(1)
+
+	// Requests of unknown commands are refused before the client solves a challenge for them
+	if c.server.commands != nil && !c.server.commands(req.Command()) {
+		err := errUnknownCommand(req.Command())
+		c.server.metrics.Request(req.Command(), 0, err)
+		failSpan(span, err)
+		return c.failRequest(s, err)
+	}
 
-		// Perform challenge-response, if the protocol is implemented
-		if c.server.crProto != serverChallengeResponse(nil) {
-			err = c.server.crProto.ChallengeResponse(c.rwc, []byte(fmt.Sprint(c.rwc.RemoteAddr().String(), c.rwc.LocalAddr().String())))
-			if err != nil {
-				if !c.server.crProto.IsError(err) {
-					c.server.logger.Errorf("serve - ChallengeResponse: %v. From = %s.", err, c.rwc.RemoteAddr().String())
+	// Perform challenge-response, if the protocol is implemented and enabled for the connection
+	if c.pow() && !c.redeemAccess(span, token) {
+		err := c.challengeResponse(ctx, s)
+		if err != nil {
+			failSpan(span, err)
+			if c.server.controller != nil {
+				c.server.controller.challengeFailed()
+			}
+			c.recordFailure(err)
+			if c.server.reputation != nil && ctx.Err() == nil && !c.server.shuttingDown() {
+				if event, ok := failureEvent(err); ok {
+					c.server.reputation.record(c.reputationKey(), event)
 				}
-				if err = c.rwc.Close(); err != nil {
-					c.server.logger.Fatal(err)
+			}
+			switch {
+			case c.server.crProto.IsError(err) || errors.Is(err, ErrServerBusy) || ctx.Err() != nil || c.server.shuttingDown():
+			case isDisconnect(err):
+				c.server.logger.Debugw("protocol: client disconnected", "conn", c.id, "error", err)
+			default:
+				c.server.logger.Errorf("serve - ChallengeResponse: %v. From = %s.", err, c.rwc.RemoteAddr().String())
+			}
+			if s.multiplexed() {
+				if ctx.Err() == nil {
+					s.fail(err)
 				}
-				return
+				return true
+			}
+			if ctx.Err() == nil {
+				c.sendError(err)
 			}
+			c.closeQuietly()
+			return false
 		}
 
-		// Call the server's handler function to handle the connection
-		request := Request(req)
-		res, err := c.server.handler(&request)
+		c.server.metrics.ChallengeSolved()
+
+		err = c.grantAccess(s)
 		if err != nil {
-			c.close(fmt.Errorf("serve - handler: %v", err))
-			return
+			c.close(fmt.Errorf("serve - grantAccess: %w", err))
+			return false
+		}
+	}
+
+	// Call the server's handler function to handle the connection,
+	// the request is canceled if the peer disconnects meanwhile.
+	// The reader of a multiplexed connection watches the peer itself
+	stop := func() {}
+	if !s.multiplexed() {
+		stop = c.backgroundRead(cancel)
+	}
+	handlerCtx, handlerSpan := c.server.tracer.Start(ctx, "wow.handler", trace.WithAttributes(attrCommand.String(req.Command())))
+	res, err := c.server.handler(handlerCtx, &req)
+	endSpan(handlerSpan, err)
+	stop()
+	if err != nil {
+		failSpan(span, err)
+		if ctx.Err() != nil {
+			_ = c.rwc.Close()
+			return false
+		}
+		return c.failRequest(s, err)
+	}
+	// Send Response to the client
+	err = c.writeResponse(s, res)
+	if err != nil {
+		c.close(fmt.Errorf("serve - writeResponse: %w", err))
+		return false
+	}
+	return true
+}
+
+// failRequest answers the request with the error of the handler. It returns false if the connection has been
+// closed: only multiplexed connections and framed ones failing with a recoverable error serve further requests.
+func (c *conn) failRequest(s *stream, err error) bool {
+	if s.multiplexed() {
+		if NewServerError(err).Code == CodeInternal {
+			c.server.logger.Errorw(fmt.Sprintf("serve - handler: %v", err), "conn", c.id, "request", s.id)
+		}
+		s.fail(err)
+		return true
+	}
+	// Lines carry no errors, so the client of a line connection is told by closing it
+	c.sendError(err)
+	if c.framed() && NewServerError(err).recoverable() {
+		return true
+	}
+	c.close(fmt.Errorf("serve - handler: %w", err))
+	return false
+}
+
+// framed reports whether the connection exchanges frames.
+func (c *conn) framed() bool {
+	return c.session != nil && c.session.Version >= FramedVersion
+}
+
+// multiplexed reports whether the frames of the connection carry request IDs.
+func (c *conn) multiplexed() bool {
+	return c.session != nil && c.session.Version >= MultiplexVersion
+}
+
+// readRequest reads the next request: a newline-terminated line, or the payload of a request frame
+// along with the access token it carries, if any. Pings received meanwhile are answered.
+func (c *conn) readRequest() (Request, []byte, error) {
+	if !c.framed() {
+		// The line is read within the buffer of the reader, so a line longer than the buffer is too long anyway
+		req, err := c.br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) && c.server.maxRequestSize > 0 {
+			return "", nil, fmt.Errorf("readRequest: %w", c.requestTooLarge())
 		}
-		// Send Response to the client
-		_, err = c.rwc.Write([]byte(fmt.Sprint(string(*res), "\n")))
 		if err != nil {
-			c.close(fmt.Errorf("serve - Write: %v", err))
-			return
+			return "", nil, err
+		}
+		if err = c.checkRequestSize(Request(req[:len(req)-1])); err != nil {
+			return "", nil, fmt.Errorf("readRequest: %w", err)
 		}
+		return Request(req), nil, nil
+	}
+
+	f, err := c.readFrame()
+	if err != nil {
+		return "", nil, err
+	}
+	if f.Type != FrameRequest {
+		return "", nil, fmt.Errorf("readRequest: %w: unexpected %s frame", ErrBadRequest, f.Type)
+	}
+	req, token, err := c.parseRequest(f)
+	if err != nil {
+		return "", nil, err
 	}
+	if err = c.checkRequestSize(req); err != nil {
+		return "", nil, fmt.Errorf("readRequest: %w", err)
+	}
+	return req, token, nil
+}
+
+// checkRequestSize returns the error refusing the request if it is longer than the maximum size of the server.
+func (c *conn) checkRequestSize(req Request) error {
+	if c.server.maxRequestSize > 0 && len(req) > c.server.maxRequestSize {
+		return c.requestTooLarge()
+	}
+	return nil
+}
+
+// requestTooLarge returns the error refusing a request longer than the maximum size of the server.
+func (c *conn) requestTooLarge() error {
+	return &ServerError{Code: CodeBadRequest, Message: fmt.Sprintf("request is longer than %d bytes", c.server.maxRequestSize)}
 }
 
-// syn reads the SYN value from the connection.
-func (c *conn) syn() (int16, error) {
-	err := c.rwc.SetReadDeadline(time.Now().Add(c.server.synTimeout))
+// parseRequest returns the request of the request frame and the access token it carries, if any.
+func (c *conn) parseRequest(f *Frame) (Request, []byte, error) {
+	if f.Flags&FlagAccessToken == 0 {
+		return Request(f.Payload), nil, nil
+	}
+	if c.session.Version < AccessTokenVersion {
+		return "", nil, fmt.Errorf("parseRequest: %w: access token before version %d", ErrBadRequest, AccessTokenVersion)
+	}
+	token, payload, err := splitAccessToken(f.Payload)
 	if err != nil {
-		return 0, fmt.Errorf("syn - Read: %v", err)
+		return "", nil, fmt.Errorf("parseRequest - splitAccessToken: %w: %v", ErrBadRequest, err)
+	}
+	return Request(payload), token, nil
+}
+
+// readFrame reads the next frame other than a ping, answering pings.
+func (c *conn) readFrame() (*Frame, error) {
+	for {
+		f, err := c.dec.Decode()
+		if err != nil {
+			return nil, err
+		}
+		if f.Type != FramePing || f.Flags&FlagAck != 0 {
+			return f, nil
+		}
+		err = c.enc.Encode(&Frame{Type: FramePing, Flags: FlagAck, ID: f.ID, Payload: f.Payload})
+		if err != nil {
+			return nil, fmt.Errorf("readFrame - Encode: %w", err)
+		}
+	}
+}
+
+// writeResponse writes the response of the request: a newline-terminated line, or a response frame.
+func (c *conn) writeResponse(s *stream, res *Response) error {
+	if !c.framed() {
+		_, err := c.rwc.Write([]byte(fmt.Sprint(string(*res), "\n")))
+		return err
+	}
+	return s.send(&Frame{Type: FrameResponse, Payload: []byte(*res)})
+}
+
+// sendError sends the error frame describing err before the connection is closed.
+// Clients of the versions preceding FramedVersion get no explanation.
+func (c *conn) sendError(err error) {
+	if !c.framed() {
+		return
 	}
+	_ = c.rwc.SetWriteDeadline(time.Now().Add(errorWriteTimeout))
+	_ = c.enc.Encode(&Frame{Type: FrameError, Payload: NewServerError(err).marshal()})
+}
+
+// challengeResponse performs the challenge-response before the request is handled.
+// Frames carry the challenge and the solution since FramedVersion.
+func (c *conn) challengeResponse(ctx context.Context, s *stream) (err error) {
+	if l := c.server.limiter; l != nil {
+		err := l.acquireChallenge(c.source)
+		if err != nil {
+			return fmt.Errorf("challengeResponse - acquireChallenge: %w", err)
+		}
+		defer l.releaseChallenge(c.source)
+	}
+	if c.server.reputation != nil {
+		c.server.reputation.record(c.reputationKey(), eventRequest)
+	}
+	difficulty := c.difficulty()
+	c.server.metrics.ChallengeIssued(difficulty)
+	ctx, span := c.server.tracer.Start(ctx, "wow.challenge", trace.WithAttributes(
+		attrDifficulty.Float64(difficulty), attrAlgorithm.String(c.server.crProto.Algorithm().Name())))
+	defer func() { endSpan(span, err) }()
 
-	var syn int16
-	err = binary.Read(c.rwc, binary.LittleEndian, &syn)
+	if !c.framed() {
+		start := time.Now()
+		err = c.server.crProto.challengeResponse(ctx, c.rwc, c.clientData(), difficulty, c.session.Version == LegacyVersion)
+		span.SetAttributes(attrSolveDuration.Int64(time.Since(start).Milliseconds()))
+		return err
+	}
+
+	// The reader of a multiplexed connection is shared by the requests, only the one of the request is interrupted
+	if !s.multiplexed() {
+		stop := interruptOnDone(ctx, c.rwc)
+		defer stop()
+	}
+
+	chal, err := c.server.crProto.issueChallenge(c.clientData(), difficulty)
+	if err != nil {
+		return fmt.Errorf("challengeResponse - issueChallenge: %v", err)
+	}
+	payload := chal.payload()
+	if c.session.Version >= ChallengeParamsVersion {
+		payload, err = chal.paramsPayload()
+		if err != nil {
+			return fmt.Errorf("challengeResponse - paramsPayload: %v", err)
+		}
+	}
+	err = s.send(&Frame{Type: FrameChallenge, Payload: payload})
 	if err != nil {
-		return 0, fmt.Errorf("syn - Read: %v", err)
+		return fmt.Errorf("challengeResponse - send: %w", err)
 	}
 
-	return syn, nil
+	sent := time.Now()
+	f, err := s.recv(ctx, readDeadline(ctx, c.server.crProto.ReadTimeout()))
+	span.SetAttributes(attrSolveDuration.Int64(time.Since(sent).Milliseconds()))
+	if err != nil {
+		return fmt.Errorf("challengeResponse - recv: %w", err)
+	}
+	if f.Type != FrameSolution {
+		return fmt.Errorf("challengeResponse: %w: unexpected %s frame", ErrBadRequest, f.Type)
+	}
+	resp, err := c.server.crProto.parseResponse(f.Payload)
+	if err != nil {
+		return fmt.Errorf("challengeResponse - parseResponse: %w: %v", ErrInvalidSolution, err)
+	}
+	return c.server.crProto.verify(c.clientData(), resp)
+}
+
+// redeemAccess reports whether the access token spares the challenge of the request, and records it in the span
+// and in the reputation of the client like a challenge.
+// Invalid, expired and exhausted tokens are not an error, the client is challenged instead.
+func (c *conn) redeemAccess(span trace.Span, token []byte) (redeemed bool) {
+	defer func() { span.SetAttributes(attrAccessToken.Bool(redeemed)) }()
+	if c.server.access == nil || token == nil {
+		return false
+	}
+	key, err := c.server.crProto.key()
+	if err != nil {
+		c.server.logger.Errorf("serve - key: %v", err)
+		return false
+	}
+	err = c.server.access.redeem(key, c.clientData(), token)
+	if err != nil {
+		c.server.logger.Debugf("serve - redeem: %v. From = %s.", err, c.rwc.RemoteAddr().String())
+		return false
+	}
+	if c.server.reputation != nil {
+		c.server.reputation.record(c.reputationKey(), eventRequest)
+	}
+	return true
+}
+
+// grantAccess sends an access token to the client which has solved a challenge.
+// Clients of the versions preceding AccessTokenVersion get none.
+func (c *conn) grantAccess(s *stream) error {
+	if c.server.access == nil || !c.framed() || c.session.Version < AccessTokenVersion {
+		return nil
+	}
+	key, err := c.server.crProto.key()
+	if err != nil {
+		return fmt.Errorf("grantAccess - key: %v", err)
+	}
+	payload, err := c.server.access.issue(key, c.clientData())
+	if err != nil {
+		return fmt.Errorf("grantAccess - issue: %v", err)
+	}
+	err = s.send(&Frame{Type: FrameAccess, Payload: payload})
+	if err != nil {
+		return fmt.Errorf("grantAccess - send: %w", err)
+	}
+	return nil
+}
+
+// backgroundRead watches the connection while the request is handled and calls cancel when the peer disconnects.
+// Data sent by the peer meanwhile stays buffered for the next request.
+// The returned function stops watching and waits for the watcher to exit.
+func (c *conn) backgroundRead(cancel context.CancelFunc) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := c.br.Peek(1)
+		if ne, ok := err.(net.Error); err != nil && !(ok && ne.Timeout()) {
+			cancel()
+		}
+	}()
+
+	return func() {
+		_ = c.rwc.SetReadDeadline(aLongTimeAgo)
+		<-done
+		_ = c.rwc.SetReadDeadline(time.Time{})
+	}
+}
+
+// difficulty returns the difficulty of the challenges of the client in bits, which is the one of the protocol raised
+// by the reputation of the client. Clients of version 0 solve challenges of the complexity of their handshake.
+func (c *conn) difficulty() float64 {
+	if c.session != nil && c.session.Version == LegacyVersion {
+		return float64(c.session.Complexity)
+	}
+	bits := c.server.crProto.Difficulty()
+	if c.authenticated {
+		bits -= c.server.certPolicy.DifficultyReduction
+	}
+	if c.server.reputation != nil {
+		bits += float64(c.server.reputation.extraBits(c.reputationKey()))
+	}
+	return clampDifficulty(bits)
+}
+
+// complexity returns the difficulty of the challenges of the client rounded up to whole bits, which is
+// announced by the handshake.
+func (c *conn) complexity() uint8 {
+	return bitsOf(targetFromDifficulty(c.difficulty()))
+}
+
+// reputationKey returns the key of the reputation of the client.
+func (c *conn) reputationKey() clientKey {
+	return c.server.reputation.key(c.rwc.RemoteAddr(), c.clientID)
+}
+
+// failureEvent returns the event affecting the reputation of the client whose challenge failed with the error.
+// Failures which are not the fault of the client do not affect it.
+func failureEvent(err error) (reputationEvent, bool) {
+	if errors.Is(err, ErrServerBusy) || isDisconnect(err) {
+		return 0, false
+	}
+	switch NewServerError(err).Code {
+	case CodeInternal:
+		return 0, false
+	case CodeTimeout:
+		return eventTimeout, true
+	default:
+		return eventFailure, true
+	}
+}
+
+// recordFailure records the failed challenge in the metrics. Challenges refused by the limiter have not been issued.
+func (c *conn) recordFailure(err error) {
+	switch {
+	case errors.Is(err, ErrServerBusy):
+	case NewServerError(err).Code == CodeTimeout:
+		c.server.metrics.ChallengeTimedOut()
+	default:
+		c.server.metrics.ChallengeFailed()
+	}
+}
+
+// clientData returns the data challenges of the connection are bound to. Only the host of the client is used,
+// so a challenge solved on a lost connection can be redeemed on a new one.
+func (c *conn) clientData() []byte {
+	host, _, err := net.SplitHostPort(c.rwc.RemoteAddr().String())
+	if err != nil {
+		return []byte(c.rwc.RemoteAddr().String())
+	}
+	return []byte(host)
 }
 
 // ack sends the ACK value (syn + pow) to the connection.
@@ -173,10 +772,42 @@ func (c *conn) ack(syn, pow int16) error {
 	return err
 }
 
-// close connection and log.
+// close connection and log. An error of a single connection never stops the server: errors caused by
+// the client going away are logged at the debug level, the others at the error level.
 func (c *conn) close(err error) {
-	c.server.logger.Error(err)
-	if err = c.rwc.Close(); err != nil {
-		c.server.logger.Fatal(err)
+	switch {
+	case c.server.shuttingDown():
+		// Errors caused by connections closed on shutdown are expected
+	case isDisconnect(err):
+		c.server.logger.Debugw("protocol: client disconnected", "conn", c.id, "error", err)
+	default:
+		c.server.logger.Errorw(err.Error(), "conn", c.id, "remote", c.rwc.RemoteAddr().String())
+	}
+	c.closeQuietly()
+}
+
+// closeQuietly closes the connection, logging the failure at the debug level.
+func (c *conn) closeQuietly() {
+	if err := c.rwc.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		c.server.logger.Debugw("protocol: Close error", "conn", c.id, "error", err)
 	}
 }
+
+// recoverPanic recovers a panic of the goroutine serving the connection, so it takes down only
+// the connection: the panic is logged with the stack and the client gets an internal error.
+func (c *conn) recoverPanic() {
+	p := recover()
+	if p == nil {
+		return
+	}
+	c.server.logger.Errorw("protocol: panic serving connection", "conn", c.id, "remote", c.rwc.RemoteAddr().String(),
+		"panic", p, "stack", string(debug.Stack()))
+	c.sendError(ErrInternal)
+	c.closeQuietly()
+}
+
+// isDisconnect reports whether the error is caused by the client closing or resetting the connection.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
@@ -1,13 +1,18 @@
 package protocol
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"math/rand"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,7 +22,7 @@ func TestServer_ServePOW(t *testing.T) {
 	address := "localhost:12345"
 	testQuote := "Test quote"
 
-	server := NewServer(logger.Sugar(), NewProofOfWork(20, time.Second*60), time.Second*60, func(request *Request) (*Response, error) {
+	server := NewServer(logger.Sugar(), NewProofOfWork(20, time.Second*60), time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
 		response := Response(testQuote)
 		return &response, nil
 	})
@@ -50,7 +55,7 @@ func TestServer_Serve(t *testing.T) {
 	address := "localhost:12344"
 	testQuote := "Test quote"
 
-	server := NewServer(logger.Sugar(), nil, time.Second*60, func(request *Request) (*Response, error) {
+	server := NewServer(logger.Sugar(), nil, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
 		response := Response(testQuote)
 		return &response, nil
 	})
@@ -78,6 +83,44 @@ func TestServer_Serve(t *testing.T) {
 	}
 }
 
+func TestServer_ServePanic(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	var panicking atomic.Bool
+	panicking.Store(true)
+
+	server := NewServer(zap.New(core).Sugar(), nil, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		if panicking.Load() {
+			panic("boom")
+		}
+		response := Response("Test quote")
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	// The panic takes down only the connection, the client gets an internal error
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.GetQuote()
+	require.ErrorIs(t, err, ErrInternal)
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("protocol: panic serving connection").Len() == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Contains(t, logs.FilterMessage("protocol: panic serving connection").All()[0].ContextMap()["stack"], "recoverPanic")
+
+	// The server keeps serving the other clients
+	panicking.Store(false)
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, c.Reconnect(conn))
+	quote, err := c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, "Test quote", quote)
+}
+
 func zapLoggerInit(serviceName string) (*zap.Logger, error) {
 	srvField := zap.Fields(zap.Field{
 		Key:    "service",
@@ -91,3 +134,105 @@ func zapLoggerInit(serviceName string) (*zap.Logger, error) {
 	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
 	return cfg.Build(srvField)
 }
+
+func TestServer_MaxRequestSize(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	// The challenges are too hard to be solved within the test, so the requests must be refused before them
+	server := NewServer(logger.Sugar(), NewProofOfWork(40, time.Second*10), time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	}, WithMaxRequestSize(8))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// A multiplexed connection refuses the request alone
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.Do(ctx, "Echo", "0123456789")
+	require.ErrorIs(t, err, ErrBadRequest)
+	_, err = c.Do(ctx, "Echo", "0123456789")
+	require.ErrorIs(t, err, ErrBadRequest)
+
+	// A framed connection is told why it is closed
+	enc, dec := testHandshake(t, l.Addr().String(), AccessTokenVersion)
+	require.NoError(t, enc.Encode(&Frame{Type: FrameRequest, Payload: []byte("Echo 0123456789")}))
+	f, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, FrameError, f.Type)
+	serverErr, err := parseServerError(f.Payload)
+	require.NoError(t, err)
+	require.Equal(t, CodeBadRequest, serverErr.Code)
+
+	// A line connection is closed instead of challenged
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err = NewClient(conn, WithLegacyHandshake())
+	require.NoError(t, err)
+	_, err = c.Do(ctx, "Echo", "0123456789")
+	require.Error(t, err)
+	require.NoError(t, ctx.Err())
+	require.Equal(t, uint64(0), server.Stats().Requests)
+}
+
+func TestServer_Disconnect(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	handling := make(chan struct{}, 1)
+	handler := func(ctx context.Context, request *Request) (*Response, error) {
+		handling <- struct{}{}
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	listen := func(server *Server) string {
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		go server.Serve(l)
+		return l.Addr().String()
+	}
+	addr := listen(NewServer(zap.New(core).Sugar(), nil, time.Second*60, handler))
+	// The challenges are too hard to be solved within the test, so the client resets the connection meanwhile
+	powAddr := listen(NewServer(zap.New(core).Sugar(), NewProofOfWork(40, time.Second*10), time.Second*60, handler))
+	reset := func(conn net.Conn) {
+		require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+		require.NoError(t, conn.Close())
+	}
+
+	// Reset in the middle of the handshake
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write(helloMagic[:3])
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond * 50)
+	reset(conn)
+
+	// Reset while the request of a multiplexed connection is handled
+	conn, err = net.Dial("tcp", addr)
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	go func() { _, _ = c.GetQuote() }()
+	<-handling
+	reset(conn)
+
+	// Reset while the challenge of a line connection is solved
+	conn, err = net.Dial("tcp", powAddr)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(conn, binary.LittleEndian, int16(1)))
+	var ack int32
+	require.NoError(t, binary.Read(conn, binary.LittleEndian, &ack))
+	_, err = conn.Write([]byte("GetQuote\n"))
+	require.NoError(t, err)
+	_, err = bufio.NewReader(conn).ReadBytes('|')
+	require.NoError(t, err)
+	reset(conn)
+
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("protocol: client disconnected").Len() == 3
+	}, time.Second*5, time.Millisecond*10)
+	require.Zero(t, logs.FilterLevelExact(zapcore.ErrorLevel).Len(), logs.FilterLevelExact(zapcore.ErrorLevel).All())
+}
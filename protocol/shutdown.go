@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// shutdownPollInterval - interval between two checks of the connections by Shutdown.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// ErrServerClosed is returned by Serve and ServeContext after a call to Shutdown or Close.
+var ErrServerClosed = errors.New("protocol: Server closed")
+
+// connState represents the state of a served connection.
+type connState int32
+
+const (
+	// stateActive - the connection is handshaking or serving a request, including its challenge
+	stateActive connState = iota
+	// stateIdle - the connection waits for a request
+	stateIdle
+	// stateClosed - the connection has been closed by Shutdown or Close
+	stateClosed
+)
+
+// setState sets the state of the connection.
+func (c *conn) setState(state connState) {
+	c.state.Store(int32(state))
+}
+
+// Shutdown gracefully shuts down the server: it closes the listeners, then closes idle connections
+// and waits for the active ones to finish their requests and become idle. When ctx is done first,
+// the remaining connections are closed and ctx.Err() is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.closeConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes the listeners and all connections of the server, interrupting requests in progress.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	s.closeConns()
+	return err
+}
+
+// shuttingDown reports whether Shutdown or Close has been called.
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// trackListener adds or removes the listener being served.
+// It returns false if a listener is added to the server which is shutting down.
+func (s *Server) trackListener(l *net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[*net.Listener]struct{})
+	}
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// trackConn adds or removes the connection being served.
+func (s *Server) trackConn(c *conn, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[*conn]struct{})
+	}
+	if add {
+		s.conns[c] = struct{}{}
+	} else {
+		delete(s.conns, c)
+	}
+}
+
+// closeListenersLocked closes the listeners of the server. s.mu must be held.
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if cerr := (*l).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// closeIdleConns closes the connections waiting for a request and reports whether no connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		if c.state.CompareAndSwap(int32(stateIdle), int32(stateClosed)) {
+			_ = c.rwc.Close()
+			delete(s.conns, c)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// closeConns closes all connections of the server.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		c.setState(stateClosed)
+		_ = c.rwc.Close()
+		delete(s.conns, c)
+	}
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Shutdown(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Test quote"
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	server := NewServer(logger.Sugar(), nil, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		close(started)
+		<-release
+		response := Response(testQuote)
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	// An idle connection is closed right away
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = NewClient(idle)
+	require.NoError(t, err)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	quotes := make(chan string, 1)
+	go func() {
+		quote, _ := c.GetQuote()
+		quotes <- quote
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(context.Background()) }()
+	require.ErrorIs(t, <-served, ErrServerClosed)
+
+	_, err = idle.Read(make([]byte, 1))
+	require.Error(t, err)
+
+	// The active request is finished before Shutdown returns
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the request was finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	require.Equal(t, testQuote, <-quotes)
+	require.NoError(t, <-shutdown)
+
+	require.ErrorIs(t, server.Serve(l), ErrServerClosed)
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+
+	server := NewServer(logger.Sugar(), nil, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	go c.GetQuote()
+	<-started
+
+	// The request outlives the deadline, so its connection is closed and the handler is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, server.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not canceled")
+	}
+}
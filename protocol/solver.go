@@ -0,0 +1,172 @@
+package protocol
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// searchBatch - number of hashes computed by a worker between checks for cancellation.
+	searchBatch = 1024
+	// defaultProgressInterval - default interval between two progress reports.
+	defaultProgressInterval = time.Second
+)
+
+// Progress represents the state of a running solver.
+type Progress struct {
+	// Hashes - number of hashes computed so far
+	Hashes uint64
+	// Expected - expected number of hashes required to solve the challenge
+	Expected float64
+	// HashRate - number of hashes computed per second
+	HashRate float64
+	// Elapsed - time since the solver started
+	Elapsed time.Duration
+	// ETA - estimated time until the expected number of hashes is computed
+	ETA time.Duration
+}
+
+// ProgressFunc is called by the solver with its progress.
+type ProgressFunc func(Progress)
+
+// SolverConfig represents the configuration of the parallel solver.
+type SolverConfig struct {
+	// Workers - number of goroutines searching for the nonce. runtime.NumCPU() is used if zero
+	Workers int
+	// ProgressInterval - interval between two progress reports. One second is used if zero
+	ProgressInterval time.Duration
+	// OnProgress - progress callback, optional. It is called from the goroutine which called the solver
+	OnProgress ProgressFunc
+}
+
+// workers returns the number of workers of the solver.
+func (cfg *SolverConfig) workers() int {
+	if cfg.Workers > 0 {
+		return cfg.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// progressInterval returns the interval between two progress reports.
+func (cfg *SolverConfig) progressInterval() time.Duration {
+	if cfg.ProgressInterval > 0 {
+		return cfg.ProgressInterval
+	}
+	return defaultProgressInterval
+}
+
+// SolveChallengeContext performs the Proof of Work challenge-solving protocol with the SHA-256 algorithm
+// using the parallel solver.
+func SolveChallengeContext(ctx context.Context, conn net.Conn, targetBits uint8, cfg SolverConfig) error {
+	return NewProofOfWork(targetBits, 0).SolveChallengeContext(ctx, conn, cfg)
+}
+
+// SolveChallengeContext performs the Proof of Work challenge-solving protocol using the parallel solver.
+// The nonce space is split between cfg.Workers goroutines, solving stops when ctx is done.
+func (pow *ProofOfWork) SolveChallengeContext(ctx context.Context, conn net.Conn, cfg SolverConfig) error {
+	chal, err := pow.readChallenge(bufio.NewReader(conn))
+	if err != nil {
+		return fmt.Errorf("SolveChallengeContext - readChallenge: %v", err)
+	}
+
+	resp, err := pow.solveContext(ctx, chal, cfg)
+	if err != nil {
+		return fmt.Errorf("SolveChallengeContext - solveContext: %w", err)
+	}
+
+	_, err = conn.Write(resp.marshal())
+	if err != nil {
+		return fmt.Errorf("SolveChallengeContext: Write error: %v", err)
+	}
+
+	return nil
+}
+
+// searchResult represents the result of a solver worker.
+type searchResult struct {
+	resp *response
+	err  error
+}
+
+// solveContext splits the nonce space between the workers and returns the first solution found.
+func (pow *ProofOfWork) solveContext(ctx context.Context, chal *challenge, cfg SolverConfig) (*response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	workers := cfg.workers()
+	results := make(chan searchResult, workers)
+	var hashes atomic.Uint64
+
+	span := math.MaxUint64 / uint64(workers)
+	for i := 0; i < workers; i++ {
+		first := uint64(i) * span
+		last := first + span - 1
+		if i == workers-1 {
+			last = math.MaxUint64
+		}
+		go func() {
+			resp, err := pow.search(ctx, chal, first, last, &hashes)
+			results <- searchResult{resp: resp, err: err}
+		}()
+	}
+
+	start := time.Now()
+	expected := pow.expectedHashes(chal)
+	report := func() {
+		if cfg.OnProgress != nil {
+			cfg.OnProgress(newProgress(hashes.Load(), expected, time.Since(start)))
+		}
+	}
+
+	ticker := time.NewTicker(cfg.progressInterval())
+	defer ticker.Stop()
+
+	var err error
+	for remaining := workers; remaining > 0; {
+		select {
+		case <-ticker.C:
+			report()
+		case res := <-results:
+			remaining--
+			if res.err == nil {
+				report()
+				return res.resp, nil
+			}
+			if err == nil || res.err != ErrUnsolvable {
+				err = res.err
+			}
+		}
+	}
+	return nil, err
+}
+
+// expectedHashes returns the expected number of hashes required to get a hash less than the target of the challenge.
+func (pow *ProofOfWork) expectedHashes(chal *challenge) float64 {
+	target := new(big.Float).SetInt(pow.challengeTarget(chal))
+
+	space := new(big.Float).SetInt(new(big.Int).Lsh(big.NewInt(1), hashBitLen))
+	expected, _ := space.Quo(space, target).Float64()
+	return expected
+}
+
+// newProgress calculates the progress of the solver.
+func newProgress(hashes uint64, expected float64, elapsed time.Duration) Progress {
+	p := Progress{Hashes: hashes, Expected: expected, Elapsed: elapsed}
+	if elapsed > 0 {
+		p.HashRate = float64(hashes) / elapsed.Seconds()
+	}
+	if p.HashRate > 0 && expected > float64(hashes) {
+		p.ETA = time.Duration(math.MaxInt64)
+		if eta := (expected - float64(hashes)) / p.HashRate * float64(time.Second); eta < math.MaxInt64 {
+			p.ETA = time.Duration(eta)
+		}
+	}
+	return p
+}
@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProofOfWork_SolveChallengeContext(t *testing.T) {
+	data := []byte("127.0.0.1")
+	for _, workers := range []int{0, 1, 4} {
+		pow := NewProofOfWork(16, time.Second*10)
+
+		// The progress is reported on the goroutine of the solver, so it is asserted once the challenge is solved
+		var reports atomic.Int64
+		var expected atomic.Value
+		server, client := net.Pipe()
+		go pow.SolveChallengeContext(context.Background(), client, SolverConfig{
+			Workers:          workers,
+			ProgressInterval: time.Millisecond,
+			OnProgress: func(p Progress) {
+				reports.Add(1)
+				expected.Store(p.Expected)
+			},
+		})
+
+		err := pow.ChallengeResponse(server, data)
+		require.NoError(t, err)
+		require.Positive(t, reports.Load())
+		require.Equal(t, float64(1<<16), expected.Load())
+	}
+}
+
+func TestProofOfWork_SolveContextCancel(t *testing.T) {
+	pow := NewProofOfWork(hashBitLen-1, 0)
+	chal, err := pow.newChallenge([]byte("127.0.0.1"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var last Progress
+	_, err = pow.solveContext(ctx, chal, SolverConfig{
+		Workers:          2,
+		ProgressInterval: 10 * time.Millisecond,
+		OnProgress:       func(p Progress) { last = p },
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Positive(t, last.Hashes)
+	require.Positive(t, last.HashRate)
+	require.Positive(t, last.ETA)
+}
+
+func TestClient_GetQuoteContext(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Test quote"
+	pow := NewProofOfWork(12, time.Second*10)
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response(testQuote)
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn, WithSolver(SolverConfig{Workers: 2}))
+	require.NoError(t, err)
+
+	quote, err := c.GetQuoteContext(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, testQuote, quote)
+
+	// Solving is interrupted, the client must be reconnected
+	pow.IncreaseComplexity()
+	c.crProto = NewProofOfWork(hashBitLen-1, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.GetQuoteContext(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, c.Reconnect(conn))
+	quote, err = c.GetQuoteContext(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, testQuote, quote)
+}
@@ -0,0 +1,143 @@
+package protocol
+
+import (
+	"sort"
+	"time"
+)
+
+// ConnInfo represents a connection being served.
+type ConnInfo struct {
+	// ID - ID of the connection, unique within the server
+	ID uint64
+	// RemoteAddr - address of the client
+	RemoteAddr string
+	// ClientID - ID the client sent in HELLO, empty if none
+	ClientID string
+	// Version - negotiated protocol version, zero until the handshake completes and for version 0 clients
+	Version uint8
+	// Handshaken - whether the handshake has completed
+	Handshaken bool
+	// Idle - whether the connection waits for a request
+	Idle bool
+	// Pow - whether the requests of the connection are challenged
+	Pow bool
+	// Authenticated - whether the client presented a certificate verified by the TLS handshake
+	Authenticated bool
+	// Since - the time the connection was accepted
+	Since time.Time
+	// Requests - the number of requests received on the connection
+	Requests uint64
+}
+
+// Stats represents the state of the server.
+type Stats struct {
+	// Connections - the number of connections being served
+	Connections int
+	// IdleConnections - the number of connections waiting for a request
+	IdleConnections int
+	// Accepted - the number of connections accepted since the server was created
+	Accepted uint64
+	// Requests - the number of requests received since the server was created
+	Requests uint64
+	// PowEnabled - whether the connections accepted now are challenged
+	PowEnabled bool
+	// Difficulty - the current difficulty in bits, zero without PoW
+	Difficulty float64
+	// ShuttingDown - whether Shutdown or Close has been called
+	ShuttingDown bool
+	// Listeners - the number of listeners whose connections are accepted
+	Listeners int
+}
+
+// PowEnabled reports whether the requests of the connections handshaking now are challenged.
+func (s *Server) PowEnabled() bool {
+	return s.crProto != serverChallengeResponse(nil) && !s.powDisabled.Load()
+}
+
+// SetPowEnabled enables or disables the challenges of the connections handshaking afterwards. The clients
+// already connected have been told by the handshake whether to expect challenges, so their connections
+// keep the setting they were accepted with. PoW cannot be enabled on a server created without it.
+func (s *Server) SetPowEnabled(enabled bool) {
+	s.powDisabled.Store(!enabled)
+}
+
+// Conns returns the connections being served, in the order of their IDs.
+func (s *Server) Conns() []ConnInfo {
+	s.mu.Lock()
+	conns := make([]ConnInfo, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c.info())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// CloseConn closes the connection with the ID, interrupting its requests in progress.
+// It returns false if no such connection is served.
+func (s *Server) CloseConn(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for c := range s.conns {
+		if c.id == id {
+			c.setState(stateClosed)
+			_ = c.rwc.Close()
+			delete(s.conns, c)
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns the state of the server.
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		Accepted:     s.accepted.Load(),
+		Requests:     s.requests.Load(),
+		PowEnabled:   s.PowEnabled(),
+		ShuttingDown: s.shuttingDown(),
+	}
+	if s.crProto != serverChallengeResponse(nil) {
+		stats.Difficulty = s.crProto.Difficulty()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats.Listeners = len(s.listeners)
+	stats.Connections = len(s.conns)
+	for c := range s.conns {
+		if connState(c.state.Load()) == stateIdle {
+			stats.IdleConnections++
+		}
+	}
+	return stats
+}
+
+// info returns the description of the connection.
+func (c *conn) info() ConnInfo {
+	info := ConnInfo{
+		ID:         c.id,
+		RemoteAddr: c.rwc.RemoteAddr().String(),
+		Idle:       connState(c.state.Load()) == stateIdle,
+		Since:      c.since,
+		Requests:   c.requests.Load(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.handshaken {
+		info.Handshaken = true
+		info.ClientID = c.clientID
+		info.Version = c.session.Version
+		info.Pow = c.pow()
+		info.Authenticated = c.authenticated
+	}
+	return info
+}
+
+// pow reports whether the requests of the connection are challenged, as negotiated by the handshake.
+func (c *conn) pow() bool {
+	return c.session.Algorithm != ""
+}
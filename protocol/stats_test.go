@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Conns(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	pow := NewProofOfWork(4, time.Second*10)
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	dial := func() *Client {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		c, err := NewClient(conn)
+		require.NoError(t, err)
+		_, err = c.GetQuote()
+		require.NoError(t, err)
+		return c
+	}
+
+	challenged := dial()
+	conns := server.Conns()
+	require.Len(t, conns, 1)
+	require.Equal(t, ProtocolVersion, conns[0].Version)
+	require.True(t, conns[0].Handshaken)
+	require.True(t, conns[0].Pow)
+	require.Equal(t, uint64(1), conns[0].Requests)
+
+	// Disabling PoW spares the challenges of the new connections only, the clients already connected expect them
+	pow.SetReadTimeout(time.Second * 5)
+	server.SetPowEnabled(false)
+	require.False(t, server.PowEnabled())
+	unchallenged := dial()
+	require.Equal(t, uint8(0), unchallenged.Session().Complexity)
+	_, err = challenged.GetQuote()
+	require.NoError(t, err)
+
+	server.SetPowEnabled(true)
+	require.Equal(t, time.Second*5, dial().Session().ReadTimeout)
+
+	conns = server.Conns()
+	require.Len(t, conns, 3)
+	require.False(t, conns[1].Pow)
+	require.Equal(t, uint64(2), conns[0].Requests)
+	// The connections become idle once their responses are sent
+	require.Eventually(t, func() bool {
+		return server.Stats() == Stats{Connections: 3, IdleConnections: 3, Accepted: 3, Requests: 4, PowEnabled: true, Difficulty: 4, Listeners: 1}
+	}, time.Second*5, time.Millisecond*10)
+
+	// The closed connection is no longer served
+	require.True(t, server.CloseConn(conns[0].ID))
+	require.False(t, server.CloseConn(conns[0].ID))
+	_, err = challenged.GetQuote()
+	require.Error(t, err)
+	require.Len(t, server.Conns(), 2)
+}
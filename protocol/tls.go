@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+)
+
+// ClientCertPolicy represents the challenges of the clients authenticated by a certificate the server verified.
+type ClientCertPolicy struct {
+	// Bypass - whether the requests of authenticated clients are not challenged
+	Bypass bool
+	// DifficultyReduction - bits the difficulty of the challenges of authenticated clients is reduced by
+	DifficultyReduction float64
+}
+
+// WithTLS makes the server accept TLS connections only. The TLS handshake of a connection must complete
+// within the SYN timeout, before the handshake of the protocol. Set cfg.ClientCAs and cfg.ClientAuth
+// to authenticate the clients by their certificates, see WithClientCertPolicy.
+func WithTLS(cfg *tls.Config) ServerOption {
+	return func(s *Server) {
+		s.tlsConfig = cfg
+	}
+}
+
+// WithClientCertPolicy sets the challenges of the clients that presented a certificate verified against
+// the client CAs of the TLS configuration. Other clients are challenged as usual.
+func WithClientCertPolicy(policy ClientCertPolicy) ServerOption {
+	return func(s *Server) {
+		s.certPolicy = policy
+	}
+}
+
+// tlsHandshake performs the TLS handshake of the connection and records whether the client is
+// authenticated by its certificate.
+func (c *conn) tlsHandshake(ctx context.Context, tc *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, c.server.synTimeout)
+	defer cancel()
+
+	err := tc.HandshakeContext(ctx)
+	if err != nil {
+		return fmt.Errorf("tlsHandshake - HandshakeContext: %w", err)
+	}
+	c.authenticated = len(tc.ConnectionState().VerifiedChains) > 0
+	return nil
+}
+
+// powEnabled reports whether the requests of the connection handshaking now are challenged.
+func (c *conn) powEnabled() bool {
+	return c.server.PowEnabled() && !(c.authenticated && c.server.certPolicy.Bypass)
+}
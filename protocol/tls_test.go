@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_TLS(t *testing.T) {
+	ca, caKey := testCertificate(t, nil, nil, "Test CA")
+	serverCert := testKeyPair(t, ca, caKey, "localhost")
+	clientCert := testKeyPair(t, ca, caKey, "test client")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	logger, _ := zapLoggerInit("test")
+	listen := func(policy ClientCertPolicy) string {
+		server := NewServer(logger.Sugar(), NewProofOfWork(4, time.Second*10), time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+			response := Response("Test quote")
+			return &response, nil
+		}, WithTLS(&tls.Config{
+			Certificates: []tls.Certificate{serverCert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}), WithClientCertPolicy(policy))
+		l, err := net.Listen("tcp", "localhost:0")
+		require.NoError(t, err)
+		go server.Serve(l)
+		return l.Addr().String()
+	}
+	dial := func(addr string, certs ...tls.Certificate) *Client {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: certs})
+		require.NoError(t, err)
+		c, err := NewClient(conn)
+		require.NoError(t, err)
+		_, err = c.GetQuote()
+		require.NoError(t, err)
+		return c
+	}
+
+	// Authenticated clients bypass the challenges, the others are challenged
+	addr := listen(ClientCertPolicy{Bypass: true})
+	require.Equal(t, uint8(4), dial(addr).Session().Complexity)
+	require.Equal(t, uint8(0), dial(addr, clientCert).Session().Complexity)
+
+	// The difficulty of the challenges of authenticated clients is reduced
+	addr = listen(ClientCertPolicy{DifficultyReduction: 2})
+	require.Equal(t, uint8(4), dial(addr).Session().Complexity)
+	require.Equal(t, uint8(2), dial(addr, clientCert).Session().Complexity)
+
+	// Plain TCP clients fail the TLS handshake
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = NewClient(conn)
+	require.Error(t, err)
+}
+
+func TestServer_TLSConns(t *testing.T) {
+	ca, caKey := testCertificate(t, nil, nil, "Test CA")
+	serverCert := testKeyPair(t, ca, caKey, "localhost")
+	clientCert := testKeyPair(t, ca, caKey, "test client")
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	logger, _ := zapLoggerInit("test")
+	server := NewServer(logger.Sugar(), NewProofOfWork(4, time.Second*10), time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response("Test quote")
+		return &response, nil
+	}, WithTLS(&tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{clientCert}})
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+
+	// Without a policy authenticated clients are challenged as usual
+	require.Equal(t, uint8(4), c.Session().Complexity)
+	conns := server.Conns()
+	require.Len(t, conns, 1)
+	require.True(t, conns[0].Authenticated)
+	require.True(t, conns[0].Pow)
+}
+
+// testCertificate creates a certificate with the common name signed by the parent, or a self-signed CA
+// certificate if parent is nil.
+func testCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{name},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+// testKeyPair creates a TLS certificate with the common name signed by the CA.
+func testKeyPair(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) tls.Certificate {
+	cert, key := testCertificate(t, ca, caKey, name)
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}
+}
@@ -0,0 +1,133 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+const (
+	// tokenVersion - version of the challenge token layout.
+	tokenVersion = 2
+	// tokenBitsVersion - version of the challenge token layout carrying target bits instead of the target.
+	// Such tokens issued by servers not upgraded yet are still accepted.
+	tokenBitsVersion = 1
+	// saltLen - len of the random salt of a challenge token in bytes.
+	saltLen = 16
+	// tokenLen - len of a signed challenge token in bytes:
+	// version, target, issue time, expiry time, salt, client binding and HMAC-SHA256 signature.
+	tokenLen = 1 + targetLen + 8 + 8 + saltLen + sha256.Size + sha256.Size
+	// tokenBitsLen - len of a signed challenge token of tokenBitsVersion, with one byte of target bits.
+	tokenBitsLen = 1 + 1 + 8 + 8 + saltLen + sha256.Size + sha256.Size
+	// secretLen - len of a random HMAC key in bytes.
+	secretLen = 32
+)
+
+// token represents the content of a self-describing challenge.
+// A signed token is sent to the client as the challenge data, so any server sharing the HMAC key
+// can verify the solution without keeping the challenge.
+type token struct {
+	// target - target the challenge was issued with
+	target *big.Int
+	// issued - time the challenge was issued at
+	issued time.Time
+	// expires - time after which the solution is not accepted
+	expires time.Time
+	// salt - random part of the challenge
+	salt [saltLen]byte
+	// binding - checksum of the client data the challenge was issued for
+	binding [sha256.Size]byte
+}
+
+// clientBinding returns the checksum binding a challenge to the client data.
+func clientBinding(data []byte) [sha256.Size]byte {
+	return sha256.Sum256(data)
+}
+
+// sign encodes the token, appends its HMAC signature and returns it in base64 URL encoding,
+// so the token never contains the message delimiter.
+func (t *token) sign(key []byte) []byte {
+	raw := make([]byte, 0, tokenLen)
+	raw = append(raw, tokenVersion)
+	raw = append(raw, marshalTarget(t.target)...)
+	raw = binary.BigEndian.AppendUint64(raw, uint64(t.issued.UnixMilli()))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(t.expires.UnixMilli()))
+	raw = append(raw, t.salt[:]...)
+	raw = append(raw, t.binding[:]...)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	raw = mac.Sum(raw)
+
+	encoded := make([]byte, base64.RawURLEncoding.EncodedLen(len(raw)))
+	base64.RawURLEncoding.Encode(encoded, raw)
+	return encoded
+}
+
+// decodeToken decodes the token without verifying its signature.
+func decodeToken(data []byte) (*token, []byte, error) {
+	raw := make([]byte, base64.RawURLEncoding.DecodedLen(len(data)))
+	n, err := base64.RawURLEncoding.Decode(raw, data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decodeToken - Decode: %v", err)
+	}
+	raw = raw[:n]
+	if len(raw) == 0 {
+		return nil, nil, fmt.Errorf("decodeToken: empty token")
+	}
+
+	t := &token{}
+	var rest []byte
+	switch raw[0] {
+	case tokenVersion:
+		if len(raw) != tokenLen {
+			return nil, nil, fmt.Errorf("decodeToken: invalid token length %d", len(raw))
+		}
+		t.target, err = parseTarget(raw[1 : 1+targetLen])
+		if err != nil {
+			return nil, nil, fmt.Errorf("decodeToken - parseTarget: %v", err)
+		}
+		rest = raw[1+targetLen:]
+	case tokenBitsVersion:
+		if len(raw) != tokenBitsLen {
+			return nil, nil, fmt.Errorf("decodeToken: invalid token length %d", len(raw))
+		}
+		t.target = targetFromBits(raw[1])
+		rest = raw[2:]
+	default:
+		return nil, nil, fmt.Errorf("decodeToken: unsupported token version %d", raw[0])
+	}
+
+	t.issued = time.UnixMilli(int64(binary.BigEndian.Uint64(rest[0:8])))
+	t.expires = time.UnixMilli(int64(binary.BigEndian.Uint64(rest[8:16])))
+	copy(t.salt[:], rest[16:16+saltLen])
+	copy(t.binding[:], rest[16+saltLen:16+saltLen+sha256.Size])
+	return t, raw, nil
+}
+
+// parseToken decodes the token and verifies its signature.
+func parseToken(data, key []byte) (*token, error) {
+	t, raw, err := decodeToken(data)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := raw[:len(raw)-sha256.Size]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(signed)
+	if !hmac.Equal(mac.Sum(nil), raw[len(signed):]) {
+		return nil, fmt.Errorf("parseToken: invalid signature")
+	}
+	return t, nil
+}
+
+// boundTo reports whether the token was issued for the client data.
+func (t *token) boundTo(data []byte) bool {
+	binding := clientBinding(data)
+	return bytes.Equal(t.binding[:], binding[:])
+}
@@ -0,0 +1,127 @@
+package protocol
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestToken_Sign(t *testing.T) {
+	key := []byte("secret")
+	issued := time.Now().Truncate(time.Millisecond)
+	tok := &token{
+		target:  targetFromBits(12),
+		issued:  issued,
+		expires: issued.Add(time.Minute),
+		salt:    [saltLen]byte{1, 2, 3},
+		binding: clientBinding([]byte("127.0.0.1")),
+	}
+
+	signed := tok.sign(key)
+	require.NotContains(t, string(signed), string(del))
+
+	parsed, err := parseToken(signed, key)
+	require.NoError(t, err)
+	require.Zero(t, tok.target.Cmp(parsed.target))
+	require.True(t, tok.issued.Equal(parsed.issued))
+	require.True(t, tok.expires.Equal(parsed.expires))
+	require.Equal(t, tok.salt, parsed.salt)
+	require.True(t, parsed.boundTo([]byte("127.0.0.1")))
+	require.False(t, parsed.boundTo([]byte("127.0.0.2")))
+
+	_, err = parseToken(signed, []byte("another secret"))
+	require.Error(t, err)
+
+	tampered := append([]byte{}, signed...)
+	tampered[3] ^= 1
+	_, err = parseToken(tampered, key)
+	require.Error(t, err)
+
+	_, err = parseToken(signed[:len(signed)-4], key)
+	require.Error(t, err)
+}
+
+func TestProofOfWork_Stateless(t *testing.T) {
+	data := []byte("127.0.0.1")
+	issuer := NewProofOfWork(8, time.Second*10, WithSecret([]byte("secret")))
+	verifier := NewProofOfWork(16, time.Second*10, WithSecret([]byte("secret")))
+	stranger := NewProofOfWork(8, time.Second*10, WithSecret([]byte("another secret")))
+
+	chal, err := issuer.newChallenge(data)
+	require.NoError(t, err)
+	resp, err := issuer.solve(chal)
+	require.NoError(t, err)
+
+	// Solution is checked against the complexity of the challenge, not the current one
+	require.NoError(t, verifier.verify(data, resp))
+	require.Error(t, verifier.verify([]byte("127.0.0.2"), resp))
+	require.Error(t, stranger.verify(data, resp))
+
+	resp.nonce++
+	require.Error(t, verifier.verify(data, resp))
+}
+
+func TestClient_Reconnect(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	testQuote := "Test quote"
+	pow := NewProofOfWork(8, time.Second*10, WithSecret([]byte("secret")))
+
+	server := NewServer(logger.Sugar(), pow, time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		response := Response(testQuote)
+		return &response, nil
+	})
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+
+	// The challenge was solved, but the connection was lost before the quote was received
+	chal, err := pow.newChallenge([]byte("127.0.0.1"))
+	require.NoError(t, err)
+	c.solution, err = pow.solve(chal)
+	require.NoError(t, err)
+
+	conn, err = net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, c.Reconnect(conn))
+
+	// The pending solution is redeemed instead of solving a challenge of an unreachable complexity
+	c.crProto = NewProofOfWork(hashBitLen-1, 0)
+	quote, err := c.GetQuote()
+	require.NoError(t, err)
+	require.Equal(t, testQuote, quote)
+	require.Nil(t, c.solution)
+}
+
+func TestToken_BitsVersion(t *testing.T) {
+	key := []byte("secret")
+	issued := time.Now().Truncate(time.Millisecond)
+
+	// Tokens carrying target bits, issued by servers not upgraded yet, are still accepted
+	raw := []byte{tokenBitsVersion, 12}
+	raw = binary.BigEndian.AppendUint64(raw, uint64(issued.UnixMilli()))
+	raw = binary.BigEndian.AppendUint64(raw, uint64(issued.Add(time.Minute).UnixMilli()))
+	raw = append(raw, make([]byte, saltLen)...)
+	binding := clientBinding([]byte("127.0.0.1"))
+	raw = append(raw, binding[:]...)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	raw = mac.Sum(raw)
+
+	parsed, err := parseToken([]byte(base64.RawURLEncoding.EncodeToString(raw)), key)
+	require.NoError(t, err)
+	require.Zero(t, targetFromBits(12).Cmp(parsed.target))
+	require.True(t, parsed.expires.Equal(issued.Add(time.Minute)))
+	require.True(t, parsed.boundTo([]byte("127.0.0.1")))
+}
@@ -0,0 +1,54 @@
+package protocol
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName - name of the tracer of the server, the import path of the package.
+const tracerName = "github.com/OVantsevich/faraway-test/protocol"
+
+// Attributes of the spans of the server
+const (
+	attrRemoteAddr    = attribute.Key("net.peer.address")
+	attrConnID        = attribute.Key("wow.conn.id")
+	attrRequestID     = attribute.Key("wow.request.id")
+	attrVersion       = attribute.Key("wow.protocol.version")
+	attrCommand       = attribute.Key("wow.command")
+	attrDifficulty    = attribute.Key("wow.challenge.difficulty_bits")
+	attrAlgorithm     = attribute.Key("wow.challenge.algorithm")
+	attrSolveDuration = attribute.Key("wow.challenge.solve_duration_ms")
+	attrAccessToken   = attribute.Key("wow.access_token")
+)
+
+// WithTracerProvider makes the server trace the handshake of the connections and the phases of their requests:
+// the challenge-response and the handler. The context of the handler carries the span of the request,
+// so the spans of the handler, e.g. of its database queries, are its children.
+func WithTracerProvider(provider trace.TracerProvider) ServerOption {
+	return func(s *Server) {
+		s.tracer = provider.Tracer(tracerName)
+	}
+}
+
+// startSpan starts a server span of the connection, carrying its address and ID.
+func (c *conn) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attrRemoteAddr.String(c.rwc.RemoteAddr().String()), attrConnID.Int64(int64(c.id)))
+	return c.server.tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// failSpan records the error of the span.
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// endSpan records the error of the span, if any, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+}
@@ -0,0 +1,74 @@
+package protocol
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestServer_Tracing(t *testing.T) {
+	logger, _ := zapLoggerInit("test")
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	// The spans of the handler are children of the span of the request
+	server := NewServer(logger.Sugar(), NewProofOfWork(4, time.Second*10), time.Second*60, func(ctx context.Context, request *Request) (*Response, error) {
+		_, span := provider.Tracer("test").Start(ctx, "query")
+		span.End()
+		response := Response("Test quote")
+		return &response, nil
+	}, WithTracerProvider(provider))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	c, err := NewClient(conn)
+	require.NoError(t, err)
+	_, err = c.GetQuote()
+	require.NoError(t, err)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	require.Eventually(t, func() bool {
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+		return len(spans) == 5
+	}, time.Second*5, time.Millisecond*10)
+
+	handshake, request := spans["wow.handshake"], spans["wow.request"]
+	require.False(t, handshake.Parent().IsValid())
+	require.Contains(t, handshake.Attributes(), attrVersion.Int(int(ProtocolVersion)))
+	require.Contains(t, handshake.Attributes(), attrRemoteAddr.String(conn.LocalAddr().String()))
+	require.False(t, request.Parent().IsValid())
+	require.Equal(t, trace.SpanKindServer, request.SpanKind())
+	require.Contains(t, request.Attributes(), attrCommand.String(CmdGetQuote))
+	require.Contains(t, request.Attributes(), attrAccessToken.Bool(false))
+
+	challenge := spans["wow.challenge"]
+	require.Equal(t, request.SpanContext().SpanID(), challenge.Parent().SpanID())
+	require.Contains(t, challenge.Attributes(), attrDifficulty.Float64(4))
+	require.Contains(t, challenge.Attributes(), attrAlgorithm.String(sha256Algorithm{}.Name()))
+	require.True(t, hasAttribute(challenge.Attributes(), attrSolveDuration))
+
+	handler := spans["wow.handler"]
+	require.Equal(t, request.SpanContext().SpanID(), handler.Parent().SpanID())
+	require.Equal(t, handler.SpanContext().SpanID(), spans["query"].Parent().SpanID())
+}
+
+func hasAttribute(attrs []attribute.KeyValue, key attribute.Key) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
@@ -6,19 +6,21 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-// Development - case of Environment: Dev
-func Development(opts ...zap.Option) (*zap.Logger, error) {
+// Development - case of Environment: Dev. The level of the logger may be changed at runtime with the returned level
+func Development(opts ...zap.Option) (*zap.Logger, zap.AtomicLevel, error) {
 	cfg := zap.NewDevelopmentConfig()
 	cfg.OutputPaths = []string{"stdout"}
 	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	return cfg.Build(opts...)
+	logger, err := cfg.Build(opts...)
+	return logger, cfg.Level, err
 }
 
-// Production - case of Environment: Prod
-func Production(opts ...zap.Option) (*zap.Logger, error) {
+// Production - case of Environment: Prod. The level of the logger may be changed at runtime with the returned level
+func Production(opts ...zap.Option) (*zap.Logger, zap.AtomicLevel, error) {
 	cfg := zap.NewProductionConfig()
 	cfg.DisableStacktrace = true
 	cfg.OutputPaths = []string{"stdout"}
 	cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	return cfg.Build(opts...)
+	logger, err := cfg.Build(opts...)
+	return logger, cfg.Level, err
 }
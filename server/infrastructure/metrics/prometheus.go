@@ -0,0 +1,183 @@
+// Package metrics - metrics of the protocol server exported to Prometheus.
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/OVantsevich/faraway-test/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "wow"
+
+	resultOK    = "ok"
+	resultError = "error"
+	// otherCommand - label of the requests whose command is not known
+	otherCommand = "other"
+)
+
+// Prometheus records the metrics of the protocol server and of the Proof of Work in Prometheus collectors.
+type Prometheus struct {
+	// commands - known commands, the others are recorded as otherCommand to bound the cardinality of the labels
+	commands map[string]struct{}
+
+	connsAccepted     prometheus.Counter
+	connsActive       prometheus.Gauge
+	handshakes        *prometheus.CounterVec
+	challengesIssued  prometheus.Counter
+	challengesSolved  prometheus.Counter
+	challengesFailed  prometheus.Counter
+	challengesTimeout prometheus.Counter
+	challengeBits     prometheus.Histogram
+	difficultyBits    prometheus.Gauge
+	verifyDuration    *prometheus.HistogramVec
+	requestDuration   *prometheus.HistogramVec
+	requestErrors     *prometheus.CounterVec
+}
+
+var _ protocol.Metrics = (*Prometheus)(nil)
+
+// NewPrometheus creates the collectors and registers them in reg. Requests are labeled with their command
+// if it is one of commands.
+func NewPrometheus(reg prometheus.Registerer, commands ...string) (*Prometheus, error) {
+	p := &Prometheus{
+		commands: make(map[string]struct{}, len(commands)),
+		connsAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "connections_accepted_total",
+			Help: "Number of accepted connections.",
+		}),
+		connsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "connections_active",
+			Help: "Number of connections being served.",
+		}),
+		handshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "handshakes_total",
+			Help: "Number of handshakes by negotiated protocol version and result.",
+		}, []string{"version", "result"}),
+		challengesIssued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "challenges_issued_total",
+			Help: "Number of issued challenges.",
+		}),
+		challengesSolved: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "challenges_solved_total",
+			Help: "Number of challenges whose solution was accepted.",
+		}),
+		challengesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "challenges_failed_total",
+			Help: "Number of challenges whose solution was rejected or whose client failed otherwise.",
+		}),
+		challengesTimeout: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Name: "challenges_timed_out_total",
+			Help: "Number of challenges whose solution was not received within the read timeout.",
+		}),
+		challengeBits: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "challenge_difficulty_bits",
+			Help:    "Difficulty of the issued challenges in bits.",
+			Buckets: prometheus.LinearBuckets(4, 4, 8),
+		}),
+		difficultyBits: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Name: "pow_difficulty_bits",
+			Help: "Current difficulty of the Proof of Work in bits.",
+		}),
+		verifyDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "verify_duration_seconds",
+			Help:    "Time the verification of a solution took by result.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 8),
+		}, []string{"result"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace, Name: "request_duration_seconds",
+			Help:    "Time the handler took by command.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"command"}),
+		requestErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Name: "request_errors_total",
+			Help: "Number of requests the handler failed by command and error code.",
+		}, []string{"command", "code"}),
+	}
+	for _, command := range commands {
+		p.commands[command] = struct{}{}
+	}
+
+	for _, c := range []prometheus.Collector{
+		p.connsAccepted, p.connsActive, p.handshakes,
+		p.challengesIssued, p.challengesSolved, p.challengesFailed, p.challengesTimeout,
+		p.challengeBits, p.difficultyBits, p.verifyDuration, p.requestDuration, p.requestErrors,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// ConnAccepted counts the accepted connection as active.
+func (p *Prometheus) ConnAccepted() {
+	p.connsAccepted.Inc()
+	p.connsActive.Inc()
+}
+
+// ConnClosed counts the connection as no longer active.
+func (p *Prometheus) ConnClosed() {
+	p.connsActive.Dec()
+}
+
+// Handshake counts the handshake by version and result.
+func (p *Prometheus) Handshake(version uint8, err error) {
+	if err != nil {
+		p.handshakes.WithLabelValues("", resultError).Inc()
+		return
+	}
+	p.handshakes.WithLabelValues(strconv.Itoa(int(version)), resultOK).Inc()
+}
+
+// ChallengeIssued counts the challenge and observes its difficulty.
+func (p *Prometheus) ChallengeIssued(difficulty float64) {
+	p.challengesIssued.Inc()
+	p.challengeBits.Observe(difficulty)
+}
+
+// ChallengeSolved counts the solved challenge.
+func (p *Prometheus) ChallengeSolved() {
+	p.challengesSolved.Inc()
+}
+
+// ChallengeFailed counts the failed challenge.
+func (p *Prometheus) ChallengeFailed() {
+	p.challengesFailed.Inc()
+}
+
+// ChallengeTimedOut counts the timed out challenge.
+func (p *Prometheus) ChallengeTimedOut() {
+	p.challengesTimeout.Inc()
+}
+
+// Verified observes the time the verification took by result.
+func (p *Prometheus) Verified(latency time.Duration, err error) {
+	p.verifyDuration.WithLabelValues(result(err)).Observe(latency.Seconds())
+}
+
+// DifficultyChanged sets the current difficulty.
+func (p *Prometheus) DifficultyChanged(bits float64) {
+	p.difficultyBits.Set(bits)
+}
+
+// Request observes the time the handler took and counts its error by the code sent to the client.
+func (p *Prometheus) Request(command string, latency time.Duration, err error) {
+	if _, ok := p.commands[command]; !ok {
+		command = otherCommand
+	}
+	p.requestDuration.WithLabelValues(command).Observe(latency.Seconds())
+	if err != nil {
+		code := strconv.Itoa(int(protocol.NewServerError(err).Code))
+		p.requestErrors.WithLabelValues(command, code).Inc()
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultError
+	}
+	return resultOK
+}
@@ -0,0 +1,63 @@
+package tracing
+
+import (
+	"context"
+
+	"entgo.io/ent/dialect"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Driver wraps the ent driver with a span for every query, a child of the span of its context.
+type Driver struct {
+	dialect.Driver
+	tracer trace.Tracer
+}
+
+// NewDriver creates a new ent driver tracing the queries of drv.
+func NewDriver(drv dialect.Driver, provider trace.TracerProvider) *Driver {
+	return &Driver{Driver: drv, tracer: provider.Tracer(tracerName)}
+}
+
+// Exec executes the query in a span.
+func (d *Driver) Exec(ctx context.Context, query string, args, v any) error {
+	return traceQuery(ctx, d.tracer, d.Dialect(), "Exec", query, func(ctx context.Context) error {
+		return d.Driver.Exec(ctx, query, args, v)
+	})
+}
+
+// Query executes the query in a span.
+func (d *Driver) Query(ctx context.Context, query string, args, v any) error {
+	return traceQuery(ctx, d.tracer, d.Dialect(), "Query", query, func(ctx context.Context) error {
+		return d.Driver.Query(ctx, query, args, v)
+	})
+}
+
+// Tx starts a transaction whose queries are traced.
+func (d *Driver) Tx(ctx context.Context) (dialect.Tx, error) {
+	tx, err := d.Driver.Tx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Tx{Tx: tx, tracer: d.tracer, dialect: d.Dialect()}, nil
+}
+
+// Tx wraps the ent transaction with a span for every query.
+type Tx struct {
+	dialect.Tx
+	tracer  trace.Tracer
+	dialect string
+}
+
+// Exec executes the query in a span.
+func (tx *Tx) Exec(ctx context.Context, query string, args, v any) error {
+	return traceQuery(ctx, tx.tracer, tx.dialect, "Exec", query, func(ctx context.Context) error {
+		return tx.Tx.Exec(ctx, query, args, v)
+	})
+}
+
+// Query executes the query in a span.
+func (tx *Tx) Query(ctx context.Context, query string, args, v any) error {
+	return traceQuery(ctx, tx.tracer, tx.dialect, "Query", query, func(ctx context.Context) error {
+		return tx.Tx.Query(ctx, query, args, v)
+	})
+}
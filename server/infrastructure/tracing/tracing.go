@@ -0,0 +1,66 @@
+// Package tracing - OpenTelemetry tracer provider and ent driver initialization.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName - name of the tracer of the queries, the import path of the package.
+const tracerName = "github.com/OVantsevich/faraway-test/server/infrastructure/tracing"
+
+const (
+	// ExporterStdout - exporter writing the spans to stdout, for local testing
+	ExporterStdout = "stdout"
+	// ExporterOTLP - exporter sending the spans to an OTLP/HTTP collector, configured by the OTEL_EXPORTER_OTLP_* variables
+	ExporterOTLP = "otlp"
+)
+
+// NewProvider creates a tracer provider of the service exporting the sampled spans with the exporter.
+func NewProvider(ctx context.Context, exporter, serviceName string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterStdout:
+		exp, err = stdouttrace.New()
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("NewProvider: unknown exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewProvider - New: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(serviceName)))
+	if err != nil {
+		return nil, fmt.Errorf("NewProvider - Merge: %v", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	), nil
+}
+
+// traceQuery runs the query of the dialect in a client span.
+func traceQuery(ctx context.Context, tracer trace.Tracer, dialect, op, query string, run func(ctx context.Context) error) error {
+	ctx, span := tracer.Start(ctx, "ent."+op, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemKey.String(dialect), semconv.DBStatement(query)))
+	defer span.End()
+
+	err := run(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+// Package admin - authenticated HTTP API controlling the server at runtime.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OVantsevich/faraway-test/protocol"
+	"go.uber.org/zap"
+)
+
+// maxBodySize - the maximum size of a request body in bytes
+const maxBodySize = 1 << 12
+
+// Admin handles the requests of the admin API:
+//
+//	GET    /stats                 - state of the server and the log level
+//	GET    /pow                   - PoW state: enabled, difficulty, complexity and read timeout
+//	PATCH  /pow                   - sets the fields of the body: enabled, difficulty, read_timeout_ms
+//	POST   /pow/increase          - increases the difficulty by a step
+//	POST   /pow/decrease          - decreases the difficulty by a step
+//	GET    /connections           - connections being served
+//	DELETE /connections/{id}      - closes the connection
+//	GET    /log/level             - log level, PUT {"level": "debug"} as application/json changes it
+//
+// Every request must carry the token as "Authorization: Bearer <token>".
+type Admin struct {
+	server *protocol.Server
+	// pow is nil if the server was created without PoW
+	pow *protocol.ProofOfWork
+	// controller is nil if the difficulty is not adapted to the load
+	controller *protocol.Controller
+	level      zap.AtomicLevel
+	token      []byte
+	logger     *zap.SugaredLogger
+	mux        *http.ServeMux
+}
+
+// New creates the admin API of the server authenticating the requests with the token. While the controller
+// adapts the difficulty, PATCH /pow accepts only the difficulties between its bounds, the others would be
+// undone by its next adjustments.
+func New(server *protocol.Server, pow *protocol.ProofOfWork, controller *protocol.Controller, level zap.AtomicLevel,
+	token string, logger *zap.SugaredLogger) *Admin {
+	a := &Admin{server: server, pow: pow, controller: controller, level: level, token: []byte(token), logger: logger}
+	a.mux = http.NewServeMux()
+	a.mux.HandleFunc("/stats", a.stats)
+	a.mux.HandleFunc("/pow", a.powState)
+	a.mux.HandleFunc("/pow/increase", a.powStep)
+	a.mux.HandleFunc("/pow/decrease", a.powStep)
+	a.mux.HandleFunc("/connections", a.connections)
+	a.mux.HandleFunc("/connections/", a.closeConnection)
+	a.mux.Handle("/log/level", level)
+	return a
+}
+
+// ServeHTTP authenticates the request and routes it.
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), a.token) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, http.StatusUnauthorized, errors.New("invalid or missing bearer token"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		a.logger.Infow("admin: request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+// statsResponse - body of GET /stats
+type statsResponse struct {
+	Connections     int     `json:"connections"`
+	IdleConnections int     `json:"idle_connections"`
+	Accepted        uint64  `json:"accepted"`
+	Requests        uint64  `json:"requests"`
+	PowEnabled      bool    `json:"pow_enabled"`
+	Difficulty      float64 `json:"difficulty"`
+	ShuttingDown    bool    `json:"shutting_down"`
+	LogLevel        string  `json:"log_level"`
+}
+
+func (a *Admin) stats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	s := a.server.Stats()
+	writeJSON(w, http.StatusOK, statsResponse{
+		Connections:     s.Connections,
+		IdleConnections: s.IdleConnections,
+		Accepted:        s.Accepted,
+		Requests:        s.Requests,
+		PowEnabled:      s.PowEnabled,
+		Difficulty:      s.Difficulty,
+		ShuttingDown:    s.ShuttingDown,
+		LogLevel:        a.level.String(),
+	})
+}
+
+// powResponse - body of GET /pow
+type powResponse struct {
+	Enabled       bool    `json:"enabled"`
+	Difficulty    float64 `json:"difficulty"`
+	Complexity    int     `json:"complexity"`
+	ReadTimeoutMS int64   `json:"read_timeout_ms"`
+}
+
+// powRequest - body of PATCH /pow, the fields left out are not changed
+type powRequest struct {
+	Enabled       *bool    `json:"enabled"`
+	Difficulty    *float64 `json:"difficulty"`
+	ReadTimeoutMS *int64   `json:"read_timeout_ms"`
+}
+
+func (a *Admin) powState(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+	if r.Method == http.MethodPatch {
+		if a.pow == nil {
+			writeError(w, http.StatusConflict, errors.New("the server is running without PoW, set TARGET_BITS to enable it"))
+			return
+		}
+		var req powRequest
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		switch {
+		case req.Difficulty != nil && (*req.Difficulty < 0 || *req.Difficulty > 255):
+			writeError(w, http.StatusBadRequest, errors.New("difficulty must be between 0 and 255"))
+			return
+		case req.Difficulty != nil && !a.withinBounds(*req.Difficulty):
+			minBits, maxBits := a.controller.Bounds()
+			writeError(w, http.StatusBadRequest, fmt.Errorf(
+				"difficulty must be between MIN_TARGET_BITS %d and MAX_TARGET_BITS %d while the adaptive controller runs",
+				minBits, maxBits))
+			return
+		case req.ReadTimeoutMS != nil && *req.ReadTimeoutMS < 0:
+			writeError(w, http.StatusBadRequest, errors.New("read_timeout_ms must not be negative"))
+			return
+		}
+
+		if req.Difficulty != nil {
+			a.pow.SetDifficulty(*req.Difficulty)
+		}
+		if req.ReadTimeoutMS != nil {
+			a.pow.SetReadTimeout(time.Duration(*req.ReadTimeoutMS) * time.Millisecond)
+		}
+		if req.Enabled != nil {
+			a.server.SetPowEnabled(*req.Enabled)
+		}
+	}
+	a.writePow(w)
+}
+
+// withinBounds reports whether the adaptive controller, if any, keeps the difficulty.
+func (a *Admin) withinBounds(difficulty float64) bool {
+	if a.controller == nil {
+		return true
+	}
+	minBits, maxBits := a.controller.Bounds()
+	return difficulty >= float64(minBits) && difficulty <= float64(maxBits)
+}
+
+func (a *Admin) powStep(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if a.pow == nil {
+		writeError(w, http.StatusConflict, errors.New("the server is running without PoW, set TARGET_BITS to enable it"))
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/increase") {
+		a.pow.IncreaseComplexity()
+	} else {
+		a.pow.DecreaseComplexity()
+	}
+	a.writePow(w)
+}
+
+func (a *Admin) writePow(w http.ResponseWriter) {
+	res := powResponse{Enabled: a.server.PowEnabled()}
+	if a.pow != nil {
+		res.Difficulty = a.pow.Difficulty()
+		res.Complexity = a.pow.GetComplexity()
+		res.ReadTimeoutMS = a.pow.ReadTimeout().Milliseconds()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// connectionResponse - item of the body of GET /connections
+type connectionResponse struct {
+	ID            uint64    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	ClientID      string    `json:"client_id,omitempty"`
+	Version       uint8     `json:"version"`
+	Handshaken    bool      `json:"handshaken"`
+	Idle          bool      `json:"idle"`
+	Pow           bool      `json:"pow"`
+	Authenticated bool      `json:"authenticated"`
+	Since         time.Time `json:"since"`
+	Requests      uint64    `json:"requests"`
+}
+
+func (a *Admin) connections(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	conns := a.server.Conns()
+	res := make([]connectionResponse, 0, len(conns))
+	for _, c := range conns {
+		res = append(res, connectionResponse(c))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *Admin) closeConnection(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/connections/"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid connection ID: %v", err))
+		return
+	}
+	if !a.server.CloseConn(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("connection %d is not served", id))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowMethods answers 405 unless the request has one of the methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+	return false
+}
+
+func readJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid body: %v", err)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
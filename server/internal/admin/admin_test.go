@@ -0,0 +1,198 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OVantsevich/faraway-test/protocol"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+const testToken = "0123456789abcdef"
+
+// testServer creates a server challenging its clients with the PoW, if any.
+func testServer(pow *protocol.ProofOfWork) *protocol.Server {
+	handler := func(ctx context.Context, request *protocol.Request) (*protocol.Response, error) {
+		response := protocol.Response("Test quote")
+		return &response, nil
+	}
+	if pow == nil {
+		return protocol.NewServer(zap.NewNop().Sugar(), nil, time.Second*60, handler)
+	}
+	return protocol.NewServer(zap.NewNop().Sugar(), pow, time.Second*60, handler)
+}
+
+func testRequest(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdmin_Unauthorized(t *testing.T) {
+	a := New(testServer(nil), nil, nil, zap.NewAtomicLevel(), testToken, zap.NewNop().Sugar())
+
+	for _, header := range []string{"", testToken, "Basic " + testToken, "Bearer", "Bearer" + testToken, "bearer " + testToken, "Bearer wrong-token-0123"} {
+		r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code, header)
+		require.Equal(t, `Bearer realm="admin"`, w.Header().Get("WWW-Authenticate"))
+	}
+
+	require.Equal(t, http.StatusOK, testRequest(t, a, http.MethodGet, "/stats", "").Code)
+}
+
+func TestAdmin_Pow(t *testing.T) {
+	pow := protocol.NewProofOfWork(8, time.Second*10)
+	server := testServer(pow)
+	a := New(server, pow, nil, zap.NewAtomicLevel(), testToken, zap.NewNop().Sugar())
+
+	var res powResponse
+	w := testRequest(t, a, http.MethodPatch, "/pow", `{"enabled": false, "difficulty": 12.5, "read_timeout_ms": 3000}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Equal(t, powResponse{Enabled: false, Difficulty: 12.5, Complexity: 13, ReadTimeoutMS: 3000}, res)
+	require.False(t, server.PowEnabled())
+	require.Equal(t, 3*time.Second, pow.ReadTimeout())
+
+	// The fields left out are not changed
+	w = testRequest(t, a, http.MethodPatch, "/pow", `{"enabled": true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	require.Equal(t, powResponse{Enabled: true, Difficulty: 12.5, Complexity: 13, ReadTimeoutMS: 3000}, res)
+
+	// Invalid bodies change nothing
+	for _, body := range []string{
+		`{"difficulty": -1}`,
+		`{"difficulty": 256}`,
+		`{"difficulty": "8"}`,
+		`{"read_timeout_ms": -1}`,
+		`{"read_timeout_ms": 1.5}`,
+		`{"enabled": "false"}`,
+		`{"enabled": false, "complexity": 8}`,
+		`{"enabled": false`,
+		``,
+	} {
+		w = testRequest(t, a, http.MethodPatch, "/pow", body)
+		require.Equal(t, http.StatusBadRequest, w.Code, body)
+		require.Contains(t, w.Body.String(), `"error"`)
+	}
+	require.True(t, server.PowEnabled())
+	require.Equal(t, 12.5, pow.Difficulty())
+	require.Equal(t, 3*time.Second, pow.ReadTimeout())
+
+	// Without PoW only its state can be read
+	a = New(testServer(nil), nil, nil, zap.NewAtomicLevel(), testToken, zap.NewNop().Sugar())
+	require.Equal(t, http.StatusOK, testRequest(t, a, http.MethodGet, "/pow", "").Code)
+	require.Equal(t, http.StatusConflict, testRequest(t, a, http.MethodPatch, "/pow", `{"enabled": true}`).Code)
+	require.Equal(t, http.StatusConflict, testRequest(t, a, http.MethodPost, "/pow/increase", "").Code)
+}
+
+func TestAdmin_PowController(t *testing.T) {
+	pow := protocol.NewProofOfWork(8, time.Second*10)
+	controller := protocol.NewController(zap.NewNop().Sugar(), pow, protocol.ControllerConfig{
+		MinComplexity: 4, MaxComplexity: 20, Interval: time.Second,
+	})
+	a := New(testServer(pow), pow, controller, zap.NewAtomicLevel(), testToken, zap.NewNop().Sugar())
+
+	// The difficulties the controller would undo are refused
+	for _, difficulty := range []float64{0, 3.5, 20.5, 24} {
+		w := testRequest(t, a, http.MethodPatch, "/pow", `{"difficulty": `+strconv.FormatFloat(difficulty, 'f', -1, 64)+`}`)
+		require.Equal(t, http.StatusBadRequest, w.Code, difficulty)
+		require.Contains(t, w.Body.String(), "MIN_TARGET_BITS 4 and MAX_TARGET_BITS 20")
+	}
+	require.Equal(t, float64(8), pow.Difficulty())
+
+	for _, difficulty := range []float64{4, 12.5, 20} {
+		require.Equal(t, http.StatusOK, testRequest(t, a, http.MethodPatch, "/pow", `{"difficulty": `+strconv.FormatFloat(difficulty, 'f', -1, 64)+`}`).Code)
+		require.Equal(t, difficulty, pow.Difficulty())
+	}
+}
+
+func TestAdmin_CloseConnection(t *testing.T) {
+	server := testServer(protocol.NewProofOfWork(8, time.Second*10))
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	defer server.Shutdown(context.Background())
+	a := New(server, nil, nil, zap.NewAtomicLevel(), testToken, zap.NewNop().Sugar())
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return len(server.Conns()) == 1 }, time.Second, time.Millisecond*10)
+
+	var conns []connectionResponse
+	w := testRequest(t, a, http.MethodGet, "/connections", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &conns))
+	require.Len(t, conns, 1)
+	require.Equal(t, conn.LocalAddr().String(), conns[0].RemoteAddr)
+	id := strconv.FormatUint(conns[0].ID, 10)
+
+	w = testRequest(t, a, http.MethodDelete, "/connections/"+id, "")
+	require.Equal(t, http.StatusNoContent, w.Code)
+	require.Empty(t, w.Body.String())
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Empty(t, server.Conns())
+
+	// The connection is not served anymore
+	require.Equal(t, http.StatusNotFound, testRequest(t, a, http.MethodDelete, "/connections/"+id, "").Code)
+	require.Equal(t, http.StatusBadRequest, testRequest(t, a, http.MethodDelete, "/connections/first", "").Code)
+}
+
+func TestAdmin_LogLevel(t *testing.T) {
+	level := zap.NewAtomicLevel()
+	a := New(testServer(nil), nil, nil, level, testToken, zap.NewNop().Sugar())
+
+	w := testRequest(t, a, http.MethodGet, "/log/level", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, `{"level": "info"}`, w.Body.String())
+
+	w = testRequest(t, a, http.MethodPut, "/log/level", `{"level": "debug"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, zap.DebugLevel, level.Level())
+
+	require.Equal(t, http.StatusBadRequest, testRequest(t, a, http.MethodPut, "/log/level", `{"level": "verbose"}`).Code)
+	require.Equal(t, zap.DebugLevel, level.Level())
+
+	var stats statsResponse
+	require.NoError(t, json.Unmarshal(testRequest(t, a, http.MethodGet, "/stats", "").Body.Bytes(), &stats))
+	require.Equal(t, "debug", stats.LogLevel)
+}
+
+func TestAdmin_MethodNotAllowed(t *testing.T) {
+	pow := protocol.NewProofOfWork(8, time.Second*10)
+	a := New(testServer(pow), pow, nil, zap.NewAtomicLevel(), testToken, zap.NewNop().Sugar())
+
+	for _, test := range []struct {
+		method, path, allow string
+	}{
+		{http.MethodPost, "/stats", "GET"},
+		{http.MethodPost, "/pow", "GET, PATCH"},
+		{http.MethodGet, "/pow/increase", "POST"},
+		{http.MethodDelete, "/connections", "GET"},
+		{http.MethodGet, "/connections/1", "DELETE"},
+	} {
+		w := testRequest(t, a, test.method, test.path, "")
+		require.Equal(t, http.StatusMethodNotAllowed, w.Code, test.path)
+		require.Equal(t, test.allow, w.Header().Get("Allow"), test.path)
+	}
+	require.Equal(t, float64(8), pow.Difficulty())
+}
@@ -0,0 +1,14 @@
+package config
+
+// Access - config for the access tokens granted after a solved challenge, sparing the challenges
+// of the following requests. The tokens are disabled while ACCESS_TOKEN_REQUESTS is 0.
+type Access struct {
+	AccessRequests  int   `env:"ACCESS_TOKEN_REQUESTS" envDefault:"0"`
+	AccessTTL       int64 `env:"ACCESS_TOKEN_TTL" envDefault:"60000"`
+	AccessCacheSize int   `env:"ACCESS_TOKEN_CACHE_SIZE" envDefault:"65536"`
+}
+
+// Enabled reports whether the access tokens are configured.
+func (a *Access) Enabled() bool {
+	return a.AccessRequests != 0
+}
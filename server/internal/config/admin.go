@@ -0,0 +1,13 @@
+package config
+
+// Admin - config for the HTTP listener of the admin API controlling the server at runtime.
+// The API is disabled while ADMIN_ADDR is empty, its requests must carry ADMIN_TOKEN as a bearer token.
+type Admin struct {
+	AdminAddr  string `env:"ADMIN_ADDR" envDefault:""`
+	AdminToken string `env:"ADMIN_TOKEN" envDefault:""`
+}
+
+// Enabled reports whether the admin API is exposed.
+func (a *Admin) Enabled() bool {
+	return a.AdminAddr != ""
+}
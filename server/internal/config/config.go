@@ -3,8 +3,12 @@ package config
 
 import (
 	"fmt"
+	"math"
 
+	"github.com/OVantsevich/faraway-test/protocol"
 	"github.com/caarlos0/env/v6"
+
+	"github.com/OVantsevich/faraway-test/server/infrastructure/tracing"
 )
 
 // Environment - run application environment
@@ -23,10 +27,34 @@ type Config struct {
 	ServiceHost string      `env:"SERVICE_HOST,notEmpty" envDefault:"0.0.0.0"`
 	ServicePort string      `env:"SERVICE_PORT,notEmpty" envDefault:"12345"`
 	Environment Environment `env:"ENVIRONMENT,notEmpty" envDefault:"PROD"`
+	// ShutdownTimeout - time given to the requests in progress to finish on shutdown, in milliseconds
+	ShutdownTimeout int64 `env:"SHUTDOWN_TIMEOUT" envDefault:"30000"`
+	// RequestTimeout - the time a request may take to be handled, in milliseconds
+	RequestTimeout int64 `env:"REQUEST_TIMEOUT" envDefault:"5000"`
+	// MaxRequestSize - the maximum length of a request in bytes
+	MaxRequestSize int `env:"MAX_REQUEST_SIZE" envDefault:"1024"`
+	// MaxConcurrentRequests - the maximum number of requests of a connection handled at once
+	MaxConcurrentRequests int `env:"MAX_CONCURRENT_REQUESTS" envDefault:"8"`
 
 	Sqlite
 
 	Pow
+
+	Limits
+
+	Reputation
+
+	Access
+
+	Metrics
+
+	Tracing
+
+	Admin
+
+	Health
+
+	TLS
 }
 
 // New creates a new config of the service
@@ -53,5 +81,104 @@ func (c *Config) validate() error {
 		return fmt.Errorf(`specified SQLiteMode doesn't exist`)
 	}
 
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf(`SHUTDOWN_TIMEOUT must not be negative`)
+	}
+
+	if c.RequestTimeout <= 0 || c.MaxRequestSize <= 0 {
+		return fmt.Errorf(`REQUEST_TIMEOUT and MAX_REQUEST_SIZE must be positive`)
+	}
+
+	if c.MaxConcurrentRequests < 1 || c.MaxConcurrentRequests > math.MaxUint16 {
+		return fmt.Errorf(`MAX_CONCURRENT_REQUESTS must be between 1 and 65535`)
+	}
+
+	switch {
+	case c.Limits.MaxConns < 0 || c.Limits.MaxConnsPerIP < 0 || c.Limits.MaxChallengesPerIP < 0:
+		return fmt.Errorf(`MAX_CONNS, MAX_CONNS_PER_IP and MAX_CHALLENGES_PER_IP must not be negative`)
+	case c.Limits.IPv4Prefix < 1 || c.Limits.IPv4Prefix > 32:
+		return fmt.Errorf(`LIMIT_IPV4_PREFIX must be between 1 and 32`)
+	case c.Limits.IPv6Prefix < 1 || c.Limits.IPv6Prefix > 128:
+		return fmt.Errorf(`LIMIT_IPV6_PREFIX must be between 1 and 128`)
+	case c.Limits.RetryAfter <= 0:
+		return fmt.Errorf(`RETRY_AFTER must be positive`)
+	}
+
+	if c.Reputation.Enabled() {
+		switch {
+		case c.Reputation.FailurePenalty < 0 || c.Reputation.TimeoutPenalty < 0 || c.Reputation.RequestPenalty < 0:
+			return fmt.Errorf(`FAILURE_PENALTY, TIMEOUT_PENALTY and REQUEST_PENALTY must not be negative`)
+		case c.Reputation.HalfLife <= 0 || c.Reputation.MaxExtraBits == 0 || c.Reputation.MaxClients <= 0 ||
+			c.Reputation.MaxIDsPerSubnet <= 0:
+			return fmt.Errorf(`REPUTATION_HALF_LIFE, MAX_EXTRA_BITS, MAX_CLIENTS and MAX_CLIENT_IDS_PER_SUBNET must be positive`)
+		case c.Reputation.SubnetWeight < 0 || c.Reputation.SubnetWeight > 1:
+			return fmt.Errorf(`SUBNET_WEIGHT must be between 0 and 1`)
+		}
+	}
+
+	if c.Access.Enabled() {
+		switch {
+		case c.Access.AccessRequests < 0:
+			return fmt.Errorf(`ACCESS_TOKEN_REQUESTS must not be negative`)
+		case c.Access.AccessTTL <= 0 || c.Access.AccessTTL > math.MaxUint32 || c.Access.AccessCacheSize <= 0:
+			return fmt.Errorf(`ACCESS_TOKEN_TTL and ACCESS_TOKEN_CACHE_SIZE must be positive, ACCESS_TOKEN_TTL must fit in uint32`)
+		}
+	}
+
+	if c.Tracing.Enabled() {
+		switch {
+		case c.Tracing.TracingExporter != tracing.ExporterStdout && c.Tracing.TracingExporter != tracing.ExporterOTLP:
+			return fmt.Errorf(`TRACING_EXPORTER must be stdout or otlp`)
+		case c.Tracing.TracingSampleRatio < 0 || c.Tracing.TracingSampleRatio > 1:
+			return fmt.Errorf(`TRACING_SAMPLE_RATIO must be between 0 and 1`)
+		}
+	}
+
+	if c.Admin.Enabled() && len(c.Admin.AdminToken) < 16 {
+		return fmt.Errorf(`ADMIN_TOKEN of at least 16 characters is required by the admin API`)
+	}
+
+	switch {
+	case c.TLS.Enabled() != (c.TLS.TLSKeyFile != ""):
+		return fmt.Errorf(`TLS_CERT_FILE and TLS_KEY_FILE must be set together`)
+	case !c.TLS.Enabled() && c.TLS.TLSClientCAFile != "":
+		return fmt.Errorf(`TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE`)
+	case c.TLS.ClientCertDifficultyReduction < 0 || c.TLS.ClientCertDifficultyReduction > 255:
+		return fmt.Errorf(`CLIENT_CERT_DIFFICULTY_REDUCTION must be between 0 and 255`)
+	case (c.TLS.ClientCertBypassPow || c.TLS.ClientCertDifficultyReduction != 0) && c.TLS.TLSClientCAFile == "":
+		return fmt.Errorf(`CLIENT_CERT_BYPASS_POW and CLIENT_CERT_DIFFICULTY_REDUCTION require TLS_CLIENT_CA_FILE`)
+	}
+
+	if c.Health.Enabled() && c.Health.HealthTimeout <= 0 {
+		return fmt.Errorf(`HEALTH_TIMEOUT must be positive`)
+	}
+
+	if c.Pow.TargetBits < 0 || c.Pow.TargetBits > 255 {
+		return fmt.Errorf(`TARGET_BITS must be between 0 and 255`)
+	}
+
+	if _, err := protocol.LookupAlgorithm(c.Pow.Algorithm); err != nil {
+		return err
+	}
+
+	if c.Pow.ChallengeTTL <= 0 || c.Pow.ReplayCacheSize <= 0 {
+		return fmt.Errorf(`CHALLENGE_TTL and REPLAY_CACHE_SIZE must be positive`)
+	}
+
+	if c.Pow.Adaptive.Enabled() {
+		switch {
+		case c.Pow.TargetBits == 0:
+			return fmt.Errorf(`adaptive difficulty requires TARGET_BITS to be set`)
+		case c.Pow.MinTargetBits > c.Pow.MaxTargetBits:
+			return fmt.Errorf(`MIN_TARGET_BITS must not be greater than MAX_TARGET_BITS`)
+		case c.Pow.AdjustInterval <= 0 || c.Pow.DifficultyStep <= 0:
+			return fmt.Errorf(`ADJUST_INTERVAL and DIFFICULTY_STEP must be positive`)
+		case c.Pow.LowConnections > c.Pow.HighConnections,
+			c.Pow.LowAcceptRate > c.Pow.HighAcceptRate,
+			c.Pow.LowFailureRate > c.Pow.HighFailureRate:
+			return fmt.Errorf(`low watermarks must not be greater than high watermarks`)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,13 @@
+package config
+
+// Health - config for the HTTP listener of the /healthz and /readyz endpoints.
+// The endpoints are disabled while HEALTH_ADDR is empty.
+type Health struct {
+	HealthAddr    string `env:"HEALTH_ADDR" envDefault:""`
+	HealthTimeout int64  `env:"HEALTH_TIMEOUT" envDefault:"2000"`
+}
+
+// Enabled reports whether the health endpoints are exposed.
+func (h *Health) Enabled() bool {
+	return h.HealthAddr != ""
+}
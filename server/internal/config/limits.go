@@ -0,0 +1,16 @@
+package config
+
+// Limits - config for the connection limits of the server. A zero limit disables it.
+type Limits struct {
+	MaxConns           int   `env:"MAX_CONNS" envDefault:"0"`
+	MaxConnsPerIP      int   `env:"MAX_CONNS_PER_IP" envDefault:"0"`
+	MaxChallengesPerIP int   `env:"MAX_CHALLENGES_PER_IP" envDefault:"0"`
+	IPv4Prefix         int   `env:"LIMIT_IPV4_PREFIX" envDefault:"32"`
+	IPv6Prefix         int   `env:"LIMIT_IPV6_PREFIX" envDefault:"64"`
+	RetryAfter         int64 `env:"RETRY_AFTER" envDefault:"1000"`
+}
+
+// Enabled reports whether any connection limit is configured.
+func (l *Limits) Enabled() bool {
+	return l.MaxConns != 0 || l.MaxConnsPerIP != 0 || l.MaxChallengesPerIP != 0
+}
@@ -0,0 +1,12 @@
+package config
+
+// Metrics - config for the HTTP listener exposing the metrics of the server to Prometheus at /metrics.
+// The metrics are disabled while METRICS_ADDR is empty.
+type Metrics struct {
+	MetricsAddr string `env:"METRICS_ADDR" envDefault:""`
+}
+
+// Enabled reports whether the metrics are exposed.
+func (m *Metrics) Enabled() bool {
+	return m.MetricsAddr != ""
+}
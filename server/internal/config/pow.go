@@ -2,6 +2,32 @@ package config
 
 // Pow - config for proof of work in protocol.
 type Pow struct {
-	TargetBits  uint8 `env:"TARGET_BITS,notEmpty" envDefault:"0"`
-	ReadTimeout int64 `env:"READ_TIMEOUT,notEmpty" envDefault:"60000"`
+	TargetBits      float64 `env:"TARGET_BITS,notEmpty" envDefault:"0"`
+	ReadTimeout     int64   `env:"READ_TIMEOUT,notEmpty" envDefault:"60000"`
+	Algorithm       string  `env:"POW_ALGORITHM,notEmpty" envDefault:"sha256"`
+	Secret          string  `env:"POW_SECRET"`
+	ChallengeTTL    int64   `env:"CHALLENGE_TTL,notEmpty" envDefault:"300000"`
+	ReplayCacheSize int     `env:"REPLAY_CACHE_SIZE,notEmpty" envDefault:"65536"`
+
+	Adaptive
+}
+
+// Adaptive - config for the adaptive difficulty controller.
+// The controller is disabled while MaxTargetBits is 0.
+type Adaptive struct {
+	MinTargetBits   uint8   `env:"MIN_TARGET_BITS" envDefault:"0"`
+	MaxTargetBits   uint8   `env:"MAX_TARGET_BITS" envDefault:"0"`
+	DifficultyStep  float64 `env:"DIFFICULTY_STEP" envDefault:"1"`
+	AdjustInterval  int64   `env:"ADJUST_INTERVAL" envDefault:"5000"`
+	HighConnections int64   `env:"HIGH_CONNECTIONS" envDefault:"0"`
+	LowConnections  int64   `env:"LOW_CONNECTIONS" envDefault:"0"`
+	HighAcceptRate  float64 `env:"HIGH_ACCEPT_RATE" envDefault:"0"`
+	LowAcceptRate   float64 `env:"LOW_ACCEPT_RATE" envDefault:"0"`
+	HighFailureRate float64 `env:"HIGH_FAILURE_RATE" envDefault:"0"`
+	LowFailureRate  float64 `env:"LOW_FAILURE_RATE" envDefault:"0"`
+}
+
+// Enabled reports whether the adaptive difficulty controller is configured.
+func (a *Adaptive) Enabled() bool {
+	return a.MaxTargetBits != 0
 }
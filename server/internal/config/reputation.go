@@ -0,0 +1,19 @@
+package config
+
+// Reputation - config for the reputation tracker raising the complexity for misbehaving clients.
+// The tracker is disabled while every penalty is 0.
+type Reputation struct {
+	FailurePenalty  float64 `env:"FAILURE_PENALTY" envDefault:"0"`
+	TimeoutPenalty  float64 `env:"TIMEOUT_PENALTY" envDefault:"0"`
+	RequestPenalty  float64 `env:"REQUEST_PENALTY" envDefault:"0"`
+	HalfLife        int64   `env:"REPUTATION_HALF_LIFE" envDefault:"60000"`
+	MaxExtraBits    uint8   `env:"MAX_EXTRA_BITS" envDefault:"8"`
+	SubnetWeight    float64 `env:"SUBNET_WEIGHT" envDefault:"0.5"`
+	MaxClients      int     `env:"MAX_CLIENTS" envDefault:"65536"`
+	MaxIDsPerSubnet int     `env:"MAX_CLIENT_IDS_PER_SUBNET" envDefault:"64"`
+}
+
+// Enabled reports whether the reputation tracker is configured.
+func (r *Reputation) Enabled() bool {
+	return r.FailurePenalty != 0 || r.TimeoutPenalty != 0 || r.RequestPenalty != 0
+}
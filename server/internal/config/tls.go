@@ -0,0 +1,18 @@
+package config
+
+// TLS - config for TLS of the protocol listener. TLS is disabled while TLS_CERT_FILE is empty.
+// Clients presenting a certificate verified against TLS_CLIENT_CA_FILE are authenticated: their requests
+// bypass PoW with CLIENT_CERT_BYPASS_POW, or are challenged CLIENT_CERT_DIFFICULTY_REDUCTION bits easier.
+// Clients without a certificate are still accepted and challenged as usual.
+type TLS struct {
+	TLSCertFile                   string  `env:"TLS_CERT_FILE" envDefault:""`
+	TLSKeyFile                    string  `env:"TLS_KEY_FILE" envDefault:""`
+	TLSClientCAFile               string  `env:"TLS_CLIENT_CA_FILE" envDefault:""`
+	ClientCertBypassPow           bool    `env:"CLIENT_CERT_BYPASS_POW" envDefault:"false"`
+	ClientCertDifficultyReduction float64 `env:"CLIENT_CERT_DIFFICULTY_REDUCTION" envDefault:"0"`
+}
+
+// Enabled reports whether the protocol listener accepts TLS connections.
+func (t *TLS) Enabled() bool {
+	return t.TLSCertFile != ""
+}
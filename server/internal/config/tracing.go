@@ -0,0 +1,14 @@
+package config
+
+// Tracing - config for the OpenTelemetry tracing of the connections, their requests and the queries
+// of the handlers. The tracing is disabled while TRACING_EXPORTER is empty.
+type Tracing struct {
+	// TracingExporter - stdout or otlp, the OTLP endpoint is configured by the standard OTEL_EXPORTER_OTLP_* variables
+	TracingExporter    string  `env:"TRACING_EXPORTER" envDefault:""`
+	TracingSampleRatio float64 `env:"TRACING_SAMPLE_RATIO" envDefault:"1"`
+}
+
+// Enabled reports whether the tracing is configured.
+func (t *Tracing) Enabled() bool {
+	return t.TracingExporter != ""
+}
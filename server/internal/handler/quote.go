@@ -13,6 +13,14 @@ import (
 	"github.com/OVantsevich/faraway-test/server/internal/ent"
 )
 
+// Commands of the quote server besides protocol.CmdGetQuote.
+const (
+	// CmdGetQuoteByID - returns the quote with the ID given as the argument
+	CmdGetQuoteByID = "GetQuoteByID"
+	// CmdQuoteCount - returns the number of quotes
+	CmdQuoteCount = "QuoteCount"
+)
+
 // Quote handler
 type Quote struct {
 	client *ent.Client
@@ -24,8 +32,8 @@ func NewQuoteHandler(client *ent.Client, logger *zap.SugaredLogger) *Quote {
 }
 
 // GetQuote - receiving random quote
-func (s *Quote) GetQuote(_ *protocol.Request) (*protocol.Response, error) {
-	ids, err := s.client.Quote.Query().IDs(context.Background())
+func (s *Quote) GetQuote(ctx context.Context, _ *protocol.Request) (*protocol.Response, error) {
+	ids, err := s.client.Quote.Query().IDs(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("GetQuote - IDs: %v", err)
 	}
@@ -35,7 +43,7 @@ func (s *Quote) GetQuote(_ *protocol.Request) (*protocol.Response, error) {
 		return nil, fmt.Errorf("GetQuote - Int: %v", err)
 	}
 
-	quote, err := s.client.Quote.Get(context.Background(), ids[rnd.Int64()])
+	quote, err := s.client.Quote.Get(ctx, ids[rnd.Int64()])
 	if err != nil {
 		return nil, fmt.Errorf("GetQuote - Get: %v. ID: %v", err, strconv.Itoa(int(rnd.Int64())))
 	}
@@ -43,3 +51,33 @@ func (s *Quote) GetQuote(_ *protocol.Request) (*protocol.Response, error) {
 	response := protocol.Response(quote.Data)
 	return &response, nil
 }
+
+// GetQuoteByID - receiving the quote with the ID given as the argument
+func (s *Quote) GetQuoteByID(ctx context.Context, req *protocol.Request) (*protocol.Response, error) {
+	args := req.Args()
+	if len(args) != 1 {
+		return nil, &protocol.ServerError{Code: protocol.CodeBadRequest, Message: "GetQuoteByID requires the ID of the quote"}
+	}
+
+	quote, err := s.client.Quote.Get(ctx, args[0])
+	if err != nil {
+		if ent.IsNotFound(err) {
+			return nil, fmt.Errorf("GetQuoteByID - Get: %w", protocol.ErrNotFound)
+		}
+		return nil, fmt.Errorf("GetQuoteByID - Get: %v. ID: %v", err, args[0])
+	}
+
+	response := protocol.Response(quote.Data)
+	return &response, nil
+}
+
+// QuoteCount - receiving the number of quotes
+func (s *Quote) QuoteCount(ctx context.Context, _ *protocol.Request) (*protocol.Response, error) {
+	count, err := s.client.Quote.Query().Count(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("QuoteCount - Count: %v", err)
+	}
+
+	response := protocol.Response(strconv.Itoa(count))
+	return &response, nil
+}
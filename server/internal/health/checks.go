@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/OVantsevich/faraway-test/protocol"
+
+	"github.com/OVantsevich/faraway-test/server/internal/ent"
+)
+
+// Listening checks the server accepts connections on a listener and is not shutting down. The check runs in-process, as connections
+// dialed by a probe would be counted by the adaptive difficulty controller, the metrics and the limiter.
+func Listening(server *protocol.Server) Check {
+	return func(context.Context) error {
+		stats := server.Stats()
+		switch {
+		case stats.ShuttingDown:
+			return errors.New("Listening: the server is shutting down")
+		case stats.Listeners == 0:
+			return errors.New("Listening: the server accepts no connections")
+		}
+		return nil
+	}
+}
+
+// Quotes checks the quotes table can be queried and is not empty.
+func Quotes(client *ent.Client) Check {
+	return func(ctx context.Context) error {
+		count, err := client.Quote.Query().Count(ctx)
+		if err != nil {
+			return fmt.Errorf("Quotes - Count: %v", err)
+		}
+		if count == 0 {
+			return errors.New("Quotes: the quotes table is empty")
+		}
+		return nil
+	}
+}
+
+// Serving checks the server is not shutting down.
+func Serving(server *protocol.Server) Check {
+	return func(context.Context) error {
+		if server.Stats().ShuttingDown {
+			return errors.New("Serving: the server is shutting down")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,62 @@
+package health
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OVantsevich/faraway-test/protocol"
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/OVantsevich/faraway-test/server/internal/ent/enttest"
+)
+
+func TestQuotes(t *testing.T) {
+	client := enttest.Open(t, "sqlite3", "file:quotes?mode=memory&_fk=1")
+	check := Quotes(client)
+	ctx := context.Background()
+
+	// An empty table fails the check
+	require.EqualError(t, check(ctx), "Quotes: the quotes table is empty")
+
+	_, err := client.Quote.Create().SetID(uuid.New().String()).SetData("Test quote").
+		SetCreated(time.Now()).SetUpdated(time.Now()).Save(ctx)
+	require.NoError(t, err)
+	require.NoError(t, check(ctx))
+
+	// So does a database which cannot be queried
+	require.NoError(t, client.Close())
+	require.ErrorContains(t, check(ctx), "Quotes - Count")
+}
+
+func TestListeningAndServing(t *testing.T) {
+	server := protocol.NewServer(zap.NewNop().Sugar(), protocol.NewProofOfWork(4, time.Second*10), time.Second*60,
+		func(ctx context.Context, request *protocol.Request) (*protocol.Response, error) {
+			response := protocol.Response("Test quote")
+			return &response, nil
+		})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	listening, serving := Listening(server), Serving(server)
+
+	// A server accepting no connections yet fails the liveness check only
+	require.EqualError(t, listening(ctx), "Listening: the server accepts no connections")
+	require.NoError(t, serving(ctx))
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	go server.Serve(l)
+	require.Eventually(t, func() bool { return listening(ctx) == nil }, time.Second, time.Millisecond*10)
+	require.NoError(t, serving(ctx))
+
+	// The checks open no connections
+	require.Equal(t, uint64(0), server.Stats().Accepted)
+
+	require.NoError(t, server.Shutdown(ctx))
+	require.EqualError(t, serving(ctx), "Serving: the server is shutting down")
+	require.EqualError(t, listening(ctx), "Listening: the server is shutting down")
+}
@@ -0,0 +1,100 @@
+// Package health - liveness and readiness checks of the server served over HTTP.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Check returns an error if the checked part of the server is unhealthy.
+type Check func(ctx context.Context) error
+
+// check - named check
+type check struct {
+	name string
+	fn   Check
+}
+
+// Health serves /healthz with the liveness checks and /readyz with the liveness and readiness checks.
+// They answer 200 if every check passes and 503 otherwise, with the result of every check.
+type Health struct {
+	// timeout - the time the checks of a request may take
+	timeout time.Duration
+	live    []check
+	ready   []check
+	mux     *http.ServeMux
+}
+
+// New creates the health endpoints whose checks may take up to timeout.
+func New(timeout time.Duration) *Health {
+	h := &Health{timeout: timeout, mux: http.NewServeMux()}
+	h.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, h.live)
+	})
+	h.mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, append(append([]check(nil), h.live...), h.ready...))
+	})
+	return h
+}
+
+// Live adds a liveness check, failing when the server must be restarted.
+func (h *Health) Live(name string, fn Check) *Health {
+	h.live = append(h.live, check{name: name, fn: fn})
+	return h
+}
+
+// Ready adds a readiness check, failing while the server must not get traffic.
+func (h *Health) Ready(name string, fn Check) *Health {
+	h.ready = append(h.ready, check{name: name, fn: fn})
+	return h
+}
+
+// ServeHTTP serves /healthz and /readyz.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// response - body of the answers, the results of the checks by name are "ok" or the error
+type response struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (h *Health) serve(w http.ResponseWriter, r *http.Request, checks []check) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+
+	type result struct {
+		name string
+		err  error
+	}
+	results := make(chan result, len(checks))
+	for _, c := range checks {
+		go func(c check) {
+			results <- result{name: c.name, err: c.fn(ctx)}
+		}(c)
+	}
+
+	res := response{Status: "ok", Checks: make(map[string]string, len(checks))}
+	status := http.StatusOK
+	for range checks {
+		r := <-results
+		res.Checks[r.name] = "ok"
+		if r.err != nil {
+			res.Checks[r.name] = r.err.Error()
+			res.Status, status = "fail", http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,99 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testRequest(t *testing.T, h http.Handler, method, path string) (*httptest.ResponseRecorder, response) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	var res response
+	if method == http.MethodGet && w.Code != http.StatusMethodNotAllowed {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	}
+	return w, res
+}
+
+func TestHealth(t *testing.T) {
+	passing := func(context.Context) error { return nil }
+	var quotesErr error
+	h := New(time.Second).
+		Live("listener", passing).
+		Ready("serving", passing).
+		Ready("quotes", func(context.Context) error { return quotesErr })
+
+	// Every check passes
+	w, res := testRequest(t, h, http.MethodGet, "/healthz")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	require.Equal(t, response{Status: "ok", Checks: map[string]string{"listener": "ok"}}, res)
+
+	w, res = testRequest(t, h, http.MethodGet, "/readyz")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, response{Status: "ok", Checks: map[string]string{"listener": "ok", "serving": "ok", "quotes": "ok"}}, res)
+
+	// A failing readiness check fails /readyz only, with its error
+	quotesErr = errors.New("Quotes: the quotes table is empty")
+	w, _ = testRequest(t, h, http.MethodGet, "/healthz")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w, res = testRequest(t, h, http.MethodGet, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, response{Status: "fail", Checks: map[string]string{
+		"listener": "ok", "serving": "ok", "quotes": "Quotes: the quotes table is empty",
+	}}, res)
+
+	// HEAD answers the status only
+	w, _ = testRequest(t, h, http.MethodHead, "/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	quotesErr = nil
+	w, _ = testRequest(t, h, http.MethodHead, "/readyz")
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestHealth_MethodNotAllowed(t *testing.T) {
+	checked := false
+	h := New(time.Second).Live("listener", func(context.Context) error {
+		checked = true
+		return nil
+	})
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			w, _ := testRequest(t, h, method, path)
+			require.Equal(t, http.StatusMethodNotAllowed, w.Code, method+" "+path)
+			require.Equal(t, "GET, HEAD", w.Header().Get("Allow"))
+		}
+	}
+	require.False(t, checked)
+
+	w, _ := testRequest(t, h, http.MethodPost, "/livez")
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestHealth_Timeout(t *testing.T) {
+	h := New(time.Millisecond*50).
+		Live("listener", func(context.Context) error { return nil }).
+		Ready("quotes", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+	// A check taking longer than the timeout fails the request instead of blocking it
+	start := time.Now()
+	w, res := testRequest(t, h, http.MethodGet, "/readyz")
+	require.Less(t, time.Since(start), time.Second)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, response{Status: "fail", Checks: map[string]string{
+		"listener": "ok", "quotes": context.DeadlineExceeded.Error(),
+	}}, res)
+}
@@ -2,20 +2,36 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	stdlog "log"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"entgo.io/ent/dialect/sql"
 	"github.com/OVantsevich/faraway-test/protocol"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/OVantsevich/faraway-test/server/infrastructure/logger"
+	"github.com/OVantsevich/faraway-test/server/infrastructure/metrics"
+	"github.com/OVantsevich/faraway-test/server/infrastructure/tracing"
+	"github.com/OVantsevich/faraway-test/server/internal/admin"
 	"github.com/OVantsevich/faraway-test/server/internal/config"
 	"github.com/OVantsevich/faraway-test/server/internal/ent"
 	"github.com/OVantsevich/faraway-test/server/internal/handler"
+	"github.com/OVantsevich/faraway-test/server/internal/health"
 	"github.com/OVantsevich/faraway-test/server/internal/migrations"
 )
 
@@ -28,17 +44,32 @@ func main() {
 		stdlog.Fatal(err)
 	}
 
-	zapLogger, err := zapLoggerInit(cfg.Environment, cfg.ServiceName)
+	zapLogger, level, err := zapLoggerInit(cfg.Environment, cfg.ServiceName)
 	if err != nil {
 		stdlog.Fatal(err)
 	}
 	defer zapLogger.Sync()
 	logger := zapLogger.Sugar()
 
-	client, err := ent.Open("sqlite3", cfg.SqliteConn())
+	tracerProvider := trace.NewNoopTracerProvider()
+	if cfg.Tracing.Enabled() {
+		provider, err := tracing.NewProvider(ctx, cfg.TracingExporter, cfg.ServiceName, cfg.TracingSampleRatio)
+		if err != nil {
+			logger.Fatalf("failed creating tracer provider: %v", err)
+		}
+		defer func() {
+			if err := provider.Shutdown(context.Background()); err != nil {
+				logger.Errorf("failed shutting down tracer provider: %v", err)
+			}
+		}()
+		tracerProvider = provider
+	}
+
+	drv, err := sql.Open("sqlite3", cfg.SqliteConn())
 	if err != nil {
 		logger.Fatalf("failed opening connection to sqlite: %v", err)
 	}
+	client := ent.NewClient(ent.Driver(tracing.NewDriver(drv, tracerProvider)))
 	defer client.Close()
 	if err := client.Schema.Create(ctx); err != nil {
 		logger.Fatalf("failed creating schema resources: %v", err)
@@ -49,23 +80,220 @@ func main() {
 	}
 
 	quoteHandler := handler.NewQuoteHandler(client, logger)
+	mux := protocol.NewMux()
+	mux.Handle(protocol.CmdGetQuote, quoteHandler.GetQuote)
+	mux.Handle(handler.CmdGetQuoteByID, quoteHandler.GetQuoteByID)
+	mux.Handle(handler.CmdQuoteCount, quoteHandler.QuoteCount)
 
 	l, err := net.Listen("tcp", fmt.Sprintf("%s:%s", cfg.ServiceHost, cfg.ServicePort))
 	if err != nil {
 		logger.Fatalf("failed migrating schema resources: %v", err)
 	}
 
+	middlewares := []protocol.Middleware{
+		protocol.Recovery(logger),
+		protocol.Logging(logger),
+		protocol.Timeout(time.Duration(cfg.RequestTimeout) * time.Millisecond),
+	}
+	opts := []protocol.ServerOption{
+		protocol.WithMaxRequestSize(cfg.MaxRequestSize),
+		protocol.WithCommands(mux.Handles),
+		protocol.WithMaxConcurrentRequests(cfg.MaxConcurrentRequests),
+		protocol.WithTracerProvider(tracerProvider),
+	}
+
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := serverTLSConfig(&cfg.TLS)
+		if err != nil {
+			logger.Fatalf("failed loading TLS configuration: %v", err)
+		}
+		opts = append(opts, protocol.WithTLS(tlsConfig), protocol.WithClientCertPolicy(protocol.ClientCertPolicy{
+			Bypass:              cfg.ClientCertBypassPow,
+			DifficultyReduction: cfg.ClientCertDifficultyReduction,
+		}))
+	}
+
+	var httpListeners []httpListener
+	var powOpts []protocol.PowOption
+	if cfg.Metrics.Enabled() {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		recorder, err := metrics.NewPrometheus(reg, protocol.CmdGetQuote, handler.CmdGetQuoteByID, handler.CmdQuoteCount)
+		if err != nil {
+			logger.Fatalf("failed registering metrics: %v", err)
+		}
+		opts = append(opts, protocol.WithMetrics(recorder))
+		powOpts = append(powOpts, protocol.WithPowMetrics(recorder))
+		// The latency includes the other middlewares, so the recovered panics are recorded as internal errors
+		middlewares = append([]protocol.Middleware{protocol.Latency(recorder.Request)}, middlewares...)
+
+		httpMux := http.NewServeMux()
+		httpMux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+		httpListeners = append(httpListeners, httpListener{name: "Metrics", server: &http.Server{
+			Addr: cfg.MetricsAddr, Handler: httpMux, ReadHeaderTimeout: time.Second * 10,
+		}})
+	}
+	opts = append(opts, protocol.WithMiddleware(middlewares...))
+
+	if cfg.Limits.Enabled() {
+		opts = append(opts, protocol.WithLimiter(protocol.NewLimiter(protocol.LimiterConfig{
+			MaxConns:           cfg.MaxConns,
+			MaxConnsPerIP:      cfg.MaxConnsPerIP,
+			MaxChallengesPerIP: cfg.MaxChallengesPerIP,
+			IPv4Prefix:         cfg.IPv4Prefix,
+			IPv6Prefix:         cfg.IPv6Prefix,
+			RetryAfter:         time.Duration(cfg.RetryAfter) * time.Millisecond,
+		})))
+	}
+
+	var server *protocol.Server
 	var pow *protocol.ProofOfWork
+	var controller *protocol.Controller
 	if cfg.TargetBits != 0 {
-		pow = protocol.NewProofOfWork(cfg.TargetBits, time.Duration(cfg.ReadTimeout*1000)*time.Millisecond)
+		alg, err := protocol.LookupAlgorithm(cfg.Algorithm)
+		if err != nil {
+			logger.Fatalf("failed selecting pow algorithm: %v", err)
+		}
+		powOpts = append(powOpts,
+			protocol.WithAlgorithm(alg),
+			protocol.WithChallengeTTL(time.Duration(cfg.ChallengeTTL)*time.Millisecond),
+			protocol.WithReplayCacheSize(cfg.ReplayCacheSize),
+			protocol.WithDifficulty(cfg.TargetBits),
+			protocol.WithDifficultyStep(cfg.DifficultyStep),
+		)
+		if cfg.Secret != "" {
+			powOpts = append(powOpts, protocol.WithSecret([]byte(cfg.Secret)))
+		}
+		pow = protocol.NewProofOfWork(0, time.Duration(cfg.ReadTimeout*1000)*time.Millisecond, powOpts...)
+
+		if cfg.Reputation.Enabled() {
+			opts = append(opts, protocol.WithReputation(protocol.NewReputation(protocol.ReputationConfig{
+				FailurePenalty:  cfg.FailurePenalty,
+				TimeoutPenalty:  cfg.TimeoutPenalty,
+				RequestPenalty:  cfg.RequestPenalty,
+				HalfLife:        time.Duration(cfg.HalfLife) * time.Millisecond,
+				MaxExtraBits:    cfg.MaxExtraBits,
+				SubnetWeight:    cfg.SubnetWeight,
+				IPv4Prefix:      cfg.IPv4Prefix,
+				IPv6Prefix:      cfg.IPv6Prefix,
+				MaxClients:      cfg.MaxClients,
+				MaxIDsPerSubnet: cfg.MaxIDsPerSubnet,
+			})))
+		}
+
+		if cfg.Access.Enabled() {
+			opts = append(opts, protocol.WithAccessTokens(protocol.AccessConfig{
+				MaxRequests: cfg.AccessRequests,
+				TTL:         time.Duration(cfg.AccessTTL) * time.Millisecond,
+				CacheSize:   cfg.AccessCacheSize,
+			}))
+		}
+
+		if cfg.Adaptive.Enabled() {
+			controller = protocol.NewController(logger, pow, protocol.ControllerConfig{
+				MinComplexity:   int(cfg.MinTargetBits),
+				MaxComplexity:   int(cfg.MaxTargetBits),
+				Interval:        time.Duration(cfg.AdjustInterval) * time.Millisecond,
+				HighConnections: cfg.HighConnections,
+				LowConnections:  cfg.LowConnections,
+				HighAcceptRate:  cfg.HighAcceptRate,
+				LowAcceptRate:   cfg.LowAcceptRate,
+				HighFailureRate: cfg.HighFailureRate,
+				LowFailureRate:  cfg.LowFailureRate,
+			})
+			opts = append(opts, protocol.WithController(controller))
+		}
+		server = protocol.NewServer(logger, pow, time.Second*120, mux.Serve, opts...)
+	} else {
+		server = protocol.NewServer(logger, nil, time.Second*120, mux.Serve, opts...)
+	}
+
+	if cfg.Admin.Enabled() {
+		httpListeners = append(httpListeners, httpListener{name: "Admin API", server: &http.Server{
+			Addr: cfg.AdminAddr, Handler: admin.New(server, pow, controller, level, cfg.AdminToken, logger), ReadHeaderTimeout: time.Second * 10,
+		}})
+	}
+
+	if cfg.Health.Enabled() {
+		checks := health.New(time.Duration(cfg.HealthTimeout)*time.Millisecond).
+			Live("listener", health.Listening(server)).
+			Ready("serving", health.Serving(server)).
+			Ready("quotes", health.Quotes(client))
+		httpListeners = append(httpListeners, httpListener{name: "Health endpoints", server: &http.Server{
+			Addr: cfg.HealthAddr, Handler: checks, ReadHeaderTimeout: time.Second * 10,
+		}})
 	}
-	server := protocol.NewServer(logger, pow, time.Second*120, quoteHandler.GetQuote)
 
 	logger.Infof("Server listened on: %v", l.Addr())
-	logger.Fatal(server.Serve(l))
+
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.ServeContext(ctx, l)
+	}()
+
+	for _, hl := range httpListeners {
+		go func(hl httpListener) {
+			logger.Infof("%s listened on: %v", hl.name, hl.server.Addr)
+			if err := hl.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Errorf("failed serving %s: %v", hl.name, err)
+			}
+		}(hl)
+	}
+
+	select {
+	case err = <-served:
+		logger.Fatal(err)
+	case <-sigCtx.Done():
+	}
+
+	// Let the requests in progress and their challenges finish before the connections are closed
+	logger.Info("Server is shutting down")
+	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, time.Duration(cfg.ShutdownTimeout)*time.Millisecond)
+	defer shutdownCancel()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		logger.Errorf("failed shutting down server gracefully: %v", err)
+	}
+	if err = <-served; !errors.Is(err, protocol.ErrServerClosed) {
+		logger.Error(err)
+	}
+	for _, hl := range httpListeners {
+		if err = hl.server.Shutdown(shutdownCtx); err != nil {
+			logger.Errorf("failed shutting down %s: %v", hl.name, err)
+		}
+	}
+}
+
+// serverTLSConfig loads the certificate of the server and the CAs verifying the certificates of the clients.
+func serverTLSConfig(cfg *config.TLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("serverTLSConfig - LoadX509KeyPair: %v", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("serverTLSConfig - ReadFile: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("serverTLSConfig - AppendCertsFromPEM: no certificates in %s", cfg.TLSClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// httpListener - HTTP API served besides the protocol
+type httpListener struct {
+	name   string
+	server *http.Server
 }
 
-func zapLoggerInit(env config.Environment, serviceName string) (*zap.Logger, error) {
+func zapLoggerInit(env config.Environment, serviceName string) (*zap.Logger, zap.AtomicLevel, error) {
 	srvField := zap.Fields(zap.Field{
 		Key:    "service",
 		Type:   zapcore.StringType,